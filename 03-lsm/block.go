@@ -0,0 +1,289 @@
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	DEFAULT_BLOCK_RESTART_INTERVAL = 16
+	RESTART_SIZE                   = 4
+)
+
+/*
+data_block format:
+entry entry ... entry restart restart ... restart restart_count
+
+entry format:
+shared_size, unshared_size, value_size, kind, seq, unshared_key, value
+
+Sorted keys tend to share long prefixes, so each key only stores what follows
+the prefix it shares with the key before it. Every restart_interval-th entry is
+a restart point where shared_size is 0 and the key is stored in full; the
+restart array holds their offsets so that a lookup can binary search them
+instead of decoding the block from the start.
+
+shared_size, unshared_size, value_size and seq are uvarints. Each restart and
+restart_count are 4 bytes. Blocks of version 1 tables have no seq.
+
+A key may appear in several consecutive entries, one for each version of it,
+ordered from the highest sequence number down.
+*/
+
+// blockBuilder encodes sorted items into a data block.
+type blockBuilder struct {
+	buf             bytes.Buffer
+	restartInterval int
+	restarts        []uint32
+	// number of entries since the last restart point
+	counter int
+	lastKey string
+}
+
+func newBlockBuilder(restartInterval int) *blockBuilder {
+	return &blockBuilder{restartInterval: restartInterval}
+}
+
+func (b *blockBuilder) add(item Item) {
+	shared := 0
+	if b.counter < b.restartInterval && len(b.restarts) > 0 {
+		for shared < len(b.lastKey) && shared < len(item.Key) && b.lastKey[shared] == item.Key[shared] {
+			shared++
+		}
+	} else {
+		b.restarts = append(b.restarts, uint32(b.buf.Len()))
+		b.counter = 0
+	}
+
+	var header [4*binary.MaxVarintLen64 + KIND_SIZE]byte
+	n := binary.PutUvarint(header[:], uint64(shared))
+	n += binary.PutUvarint(header[n:], uint64(len(item.Key)-shared))
+	n += binary.PutUvarint(header[n:], uint64(len(item.Value)))
+	header[n] = byte(item.Kind)
+	n += KIND_SIZE
+	n += binary.PutUvarint(header[n:], item.Seq)
+	b.buf.Write(header[:n])
+	b.buf.WriteString(item.Key[shared:])
+	b.buf.WriteString(item.Value)
+
+	b.counter++
+	b.lastKey = item.Key
+}
+
+// size returns roughly how large the block would be if it were finished now.
+func (b *blockBuilder) size() int {
+	return b.buf.Len() + RESTART_SIZE*(len(b.restarts)+1)
+}
+
+func (b *blockBuilder) empty() bool {
+	return b.buf.Len() == 0
+}
+
+// finish appends the restart array and returns the encoded block, which stays
+// valid until the next call to reset.
+func (b *blockBuilder) finish() []byte {
+	for _, restart := range b.restarts {
+		binary.Write(&b.buf, binary.BigEndian, restart)
+	}
+	binary.Write(&b.buf, binary.BigEndian, uint32(len(b.restarts)))
+	return b.buf.Bytes()
+}
+
+func (b *blockBuilder) reset() {
+	b.buf.Reset()
+	b.restarts = b.restarts[:0]
+	b.counter = 0
+	b.lastKey = ""
+}
+
+// blockIterator decodes the items of a data block one at a time. Every length
+// is checked against what's left of the block, so a malformed block is
+// reported as corruption rather than read out of bounds.
+type blockIterator struct {
+	t *Table
+	// offset of the block in the file
+	offset int64
+	// the entries, without the restart array
+	data     []byte
+	restarts []byte
+	// offset of the next entry in data, and of the last one decoded
+	index   int
+	current int
+	// key of the last entry decoded, which the next one is delta encoded
+	// against
+	key []byte
+}
+
+func (t *Table) newBlockIterator(offset int64, data []byte) (*blockIterator, error) {
+	if len(data) < RESTART_SIZE {
+		return nil, t.corruption(offset, "block too short to hold a restart count")
+	}
+	numRestarts := binary.BigEndian.Uint32(data[len(data)-RESTART_SIZE:])
+	maxRestarts := uint64(len(data)/RESTART_SIZE - 1)
+	if numRestarts == 0 || uint64(numRestarts) > maxRestarts {
+		return nil, t.corruption(offset, "malformed restart count")
+	}
+	restartsStart := len(data) - RESTART_SIZE*int(numRestarts+1)
+	return &blockIterator{
+		t:        t,
+		offset:   offset,
+		data:     data[:restartsStart],
+		restarts: data[restartsStart : len(data)-RESTART_SIZE],
+	}, nil
+}
+
+func (b *blockIterator) next() (Item, bool, error) {
+	if b.index == len(b.data) {
+		return Item{}, false, nil
+	}
+	start := b.index
+	shared, ok1 := b.uvarint()
+	unshared, ok2 := b.uvarint()
+	valSize, ok3 := b.uvarint()
+	if !ok1 || !ok2 || !ok3 || shared > uint64(len(b.key)) {
+		return Item{}, false, b.t.corruption(b.offset+int64(start), "malformed entry header")
+	}
+	kind, ok := b.take(KIND_SIZE)
+	if !ok || Kind(kind[0]) > KindTombstone {
+		return Item{}, false, b.t.corruption(b.offset+int64(start), "malformed entry kind")
+	}
+	var seq uint64
+	if b.t.formatVersion > 1 {
+		if seq, ok = b.uvarint(); !ok {
+			return Item{}, false, b.t.corruption(b.offset+int64(start), "malformed entry sequence number")
+		}
+	}
+	unsharedKey, ok := b.take(unshared)
+	if !ok {
+		return Item{}, false, b.t.corruption(b.offset+int64(start), "malformed entry key")
+	}
+	val, ok := b.take(valSize)
+	if !ok {
+		return Item{}, false, b.t.corruption(b.offset+int64(start), "malformed entry value")
+	}
+	b.key = append(b.key[:shared], unsharedKey...)
+	b.current = start
+	return Item{Key: string(b.key), Value: string(val), Kind: Kind(kind[0]), Seq: seq}, true, nil
+}
+
+// seek positions the iterator at the first entry whose key is >= key, which
+// is the newest version of it, and returns it.
+func (b *blockIterator) seek(key string) (Item, bool, error) {
+	// find the last restart point whose key is < key; every entry before it
+	// is too
+	lo, hi := 0, len(b.restarts)/RESTART_SIZE-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		restartKey, err := b.restartKey(mid)
+		if err != nil {
+			return Item{}, false, err
+		}
+		if restartKey < key {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	if err := b.seekToRestart(lo); err != nil {
+		return Item{}, false, err
+	}
+	for {
+		item, ok, err := b.next()
+		if err != nil || !ok || item.Key >= key {
+			return item, ok, err
+		}
+	}
+}
+
+// prev moves back to the entry before the last one decoded, and returns it.
+// Entries can only be decoded forwards, so it goes back to the last restart
+// point before that entry and decodes its way up to it.
+func (b *blockIterator) prev() (Item, bool, error) {
+	target := b.current
+	if target == 0 {
+		return Item{}, false, nil
+	}
+	numRestarts := len(b.restarts) / RESTART_SIZE
+	i := sort.Search(numRestarts, func(i int) bool {
+		return int(binary.BigEndian.Uint32(b.restarts[i*RESTART_SIZE:])) >= target
+	}) - 1
+	if i < 0 {
+		return Item{}, false, b.t.corruption(b.offset, "first restart point isn't at the start of the block")
+	}
+	if err := b.seekToRestart(i); err != nil {
+		return Item{}, false, err
+	}
+	for {
+		item, ok, err := b.next()
+		if err != nil {
+			return Item{}, false, err
+		}
+		if !ok || b.index > target {
+			return Item{}, false, b.t.corruption(b.offset+int64(target), "entry doesn't follow the one before it")
+		}
+		if b.index == target {
+			return item, true, nil
+		}
+	}
+}
+
+// seekToLast positions the iterator at the last entry, and returns it.
+func (b *blockIterator) seekToLast() (Item, bool, error) {
+	if err := b.seekToRestart(len(b.restarts)/RESTART_SIZE - 1); err != nil {
+		return Item{}, false, err
+	}
+	var last Item
+	for {
+		item, ok, err := b.next()
+		if err != nil {
+			return Item{}, false, err
+		}
+		if !ok {
+			return last, b.index > 0, nil
+		}
+		last = item
+	}
+}
+
+func (b *blockIterator) seekToRestart(i int) error {
+	restart := binary.BigEndian.Uint32(b.restarts[i*RESTART_SIZE:])
+	if uint64(restart) > uint64(len(b.data)) {
+		return b.t.corruption(b.offset+int64(len(b.data)+i*RESTART_SIZE), "restart point outside the block")
+	}
+	b.index = int(restart)
+	b.key = b.key[:0]
+	return nil
+}
+
+// restartKey returns the key of the entry at the i-th restart point.
+func (b *blockIterator) restartKey(i int) (string, error) {
+	if err := b.seekToRestart(i); err != nil {
+		return "", err
+	}
+	item, ok, err := b.next()
+	if err == nil && !ok {
+		err = b.t.corruption(b.offset+int64(len(b.data)+i*RESTART_SIZE), "restart point at the end of the block")
+	}
+	return item.Key, err
+}
+
+func (b *blockIterator) uvarint() (uint64, bool) {
+	x, n := binary.Uvarint(b.data[b.index:])
+	if n <= 0 {
+		return 0, false
+	}
+	b.index += n
+	return x, true
+}
+
+// take returns the next n bytes of the block, or `false` if there aren't that
+// many left.
+func (b *blockIterator) take(n uint64) ([]byte, bool) {
+	if n > uint64(len(b.data)-b.index) {
+		return nil, false
+	}
+	buf := b.data[b.index : b.index+int(n)]
+	b.index += int(n)
+	return buf, true
+}
@@ -0,0 +1,87 @@
+package table
+
+import (
+	"hash/fnv"
+)
+
+const (
+	DEFAULT_BLOOM_BITS_PER_KEY = 10
+	// past this many hash functions the filter gets slower without getting
+	// noticeably more accurate
+	MAX_BLOOM_HASHES = 30
+)
+
+/*
+filter_block format:
+bit_array, hash_count
+
+hash_count is a single byte.
+*/
+
+// bloomFilter answers whether a key may be in the table. A negative answer
+// is always right, so the data blocks don't need to be read at all; a
+// positive one is wrong at a rate that depends on the bits per key.
+type bloomFilter []byte
+
+// newBloomFilter builds a filter over the keys with the given bloomHashes
+// using bitsPerKey bits for each key.
+func newBloomFilter(hashes []uint32, bitsPerKey int) bloomFilter {
+	// ln(2) * bitsPerKey hash functions minimize the false positive rate
+	hashCount := int(float64(bitsPerKey) * 0.69)
+	if hashCount < 1 {
+		hashCount = 1
+	}
+	if hashCount > MAX_BLOOM_HASHES {
+		hashCount = MAX_BLOOM_HASHES
+	}
+
+	bits := len(hashes) * bitsPerKey
+	// tiny filters have a very high false positive rate
+	if bits < 64 {
+		bits = 64
+	}
+	byteCount := (bits + 7) / 8
+	bits = byteCount * 8
+
+	filter := make(bloomFilter, byteCount+1)
+	for _, h := range hashes {
+		delta := bloomDelta(h)
+		for i := 0; i < hashCount; i++ {
+			bit := h % uint32(bits)
+			filter[bit/8] |= 1 << (bit % 8)
+			h += delta
+		}
+	}
+	filter[byteCount] = byte(hashCount)
+	return filter
+}
+
+func (f bloomFilter) mayContain(key string) bool {
+	if len(f) < 2 {
+		return true
+	}
+	bits := uint32(len(f)-1) * 8
+	hashCount := int(f[len(f)-1])
+	h := bloomHash(key)
+	delta := bloomDelta(h)
+	for i := 0; i < hashCount; i++ {
+		bit := h % bits
+		if f[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// Every hash function is derived from a single hash of the key (double
+// hashing): bloomHash is the starting point, and bloomDelta the step.
+func bloomHash(key string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return hash.Sum32()
+}
+
+func bloomDelta(h uint32) uint32 {
+	return h>>17 | h<<15
+}
@@ -0,0 +1,286 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var errBuilderDone = errors.New("table: builder already finished or abandoned")
+
+// TableBuilder writes a table one item at a time, so that only the block
+// being built and the index need to be held in memory.
+//
+// The table is written to a temporary file next to its path, which Finish
+// renames into place; until then, and if the builder is abandoned, nothing
+// is left at the path itself.
+type TableBuilder struct {
+	path    string
+	tmpPath string
+	f       *os.File
+
+	opts       *Options
+	codec      Codec
+	block      *blockBuilder
+	properties Properties
+	index      []indexEntry
+	// bloomHash of every key, for the filter
+	hashes []uint32
+	// written out together by Finish, in their own block
+	rangeDels []RangeTombstone
+	// number of items in the block being built
+	itemCount int
+	// sequence number of the last item added
+	lastSeq uint64
+	// bytes written to the file so far
+	offset uint64
+
+	// the first write error, after which the builder can only be abandoned
+	err  error
+	done bool
+}
+
+// NewTableBuilder starts writing a table to path, replacing any file there
+// once it's finished.
+func NewTableBuilder(path string, opts *Options) (*TableBuilder, error) {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	codec := opts.compression()
+	return &TableBuilder{
+		path:       path,
+		tmpPath:    tmpPath,
+		f:          f,
+		opts:       opts,
+		codec:      codec,
+		block:      newBlockBuilder(opts.blockRestartInterval()),
+		properties: Properties{Compression: codec.Name(), CreationTime: time.Now()},
+	}, nil
+}
+
+// Add appends a key/value pair. Keys must be added in strictly increasing
+// order.
+func (b *TableBuilder) Add(key, value string) error {
+	return b.AddItem(Item{Key: key, Value: value})
+}
+
+// AddItem is like Add, but can also append a tombstone, or another version of
+// the key added last as long as its sequence number is lower.
+func (b *TableBuilder) AddItem(item Item) error {
+	if b.done {
+		return errBuilderDone
+	}
+	if b.err != nil {
+		return b.err
+	}
+	last := b.properties.LargestKey
+	if b.properties.NumEntries > 0 && (item.Key < last || item.Key == last && item.Seq >= b.lastSeq) {
+		return fmt.Errorf("table: key %q (seq %d) added after %q (seq %d); keys must be increasing, and versions of a key decreasing", item.Key, item.Seq, last, b.lastSeq)
+	}
+	if item.Kind > KindTombstone {
+		return fmt.Errorf("table: key %q has unknown kind %d", item.Key, item.Kind)
+	}
+
+	if b.block.size() > MAX_BLOCK_SIZE {
+		if b.err = b.flushBlock(); b.err != nil {
+			return b.err
+		}
+	}
+	// the filter only needs each key once, however many versions it has
+	if b.opts.bloomBitsPerKey() > 0 && (b.properties.NumEntries == 0 || item.Key != last) {
+		b.hashes = append(b.hashes, bloomHash(item.Key))
+	}
+	b.block.add(item)
+	b.properties.add(item)
+	b.itemCount++
+	b.lastSeq = item.Seq
+	return nil
+}
+
+// AddRangeTombstone records a range tombstone in the table. Unlike items,
+// range tombstones may be added in any order, at any point before Finish.
+func (b *TableBuilder) AddRangeTombstone(r RangeTombstone) error {
+	if b.done {
+		return errBuilderDone
+	}
+	if b.err != nil {
+		return b.err
+	}
+	if r.Start > r.End {
+		return fmt.Errorf("table: range tombstone starts at %q, after its end %q", r.Start, r.End)
+	}
+	b.rangeDels = append(b.rangeDels, r)
+	b.properties.addRangeTombstone(r)
+	return nil
+}
+
+// flushBlock writes out the block being built and sets up its index entry.
+func (b *TableBuilder) flushBlock() error {
+	data := b.block.finish()
+	size, compressed, err := writeBlock(b.f, data, b.codec)
+	if err != nil {
+		return err
+	}
+	// the index is keyed by the last key of each block
+	b.index = append(b.index, indexEntry{
+		key:       b.properties.LargestKey,
+		offset:    b.offset,
+		blockSize: uint64(size),
+		itemCount: uint64(b.itemCount),
+	})
+	b.offset += uint64(size) + BLOCK_TRAILER_SIZE
+	b.itemCount = 0
+
+	b.properties.DataBlocks++
+	if compressed {
+		b.properties.CompressedBlocks++
+	}
+	b.properties.DataSize += uint64(size)
+	b.properties.RawDataSize += uint64(len(data))
+
+	b.block.reset()
+	return nil
+}
+
+// writeMetaBlock writes a block other than a data block and returns its
+// handle.
+func (b *TableBuilder) writeMetaBlock(data []byte) (blockHandle, error) {
+	size, _, err := writeBlock(b.f, data, NoCompression)
+	if err != nil {
+		return blockHandle{}, err
+	}
+	h := blockHandle{b.offset, uint64(size)}
+	b.offset = h.end()
+	return h, nil
+}
+
+// writeIndexPartitions writes out the index in partitions of about size
+// bytes, and returns the top-level index over them.
+func (b *TableBuilder) writeIndexPartitions(size int) ([]indexEntry, error) {
+	var top []indexEntry
+	var buf []byte
+	count := 0
+	for i := range b.index {
+		buf = encodeIndexEntry(buf, &b.index[i])
+		count++
+		if len(buf) < size && i < len(b.index)-1 {
+			continue
+		}
+		h, err := b.writeMetaBlock(buf)
+		if err != nil {
+			return nil, err
+		}
+		top = append(top, indexEntry{key: b.index[i].key, offset: h.offset, blockSize: h.size, itemCount: uint64(count)})
+		buf = buf[:0]
+		count = 0
+	}
+	return top, nil
+}
+
+// Finish writes out the rest of the table, syncs it and moves it into place,
+// then syncs the directory so that the table is still there after a crash.
+// The builder can't be used afterwards. If Finish fails before the table is in
+// place, the table is abandoned.
+func (b *TableBuilder) Finish() error {
+	if b.done {
+		return errBuilderDone
+	}
+	if err := b.finish(); err != nil {
+		b.Abandon()
+		return err
+	}
+	if err := os.Rename(b.tmpPath, b.path); err != nil {
+		b.Abandon()
+		return err
+	}
+	b.done = true
+	return SyncDir(filepath.Dir(b.path))
+}
+
+// SyncDir makes the changes to the entries of dir, such as files created or
+// renamed in it, durable.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+func (b *TableBuilder) finish() error {
+	if b.err != nil {
+		return b.err
+	}
+	if !b.block.empty() {
+		if err := b.flushBlock(); err != nil {
+			return err
+		}
+	}
+
+	// the partitions go right after the data blocks, and have to be counted
+	// in the properties
+	var err error
+	index := b.index
+	if size := b.opts.indexPartitionSize(); size > 0 && len(index) > 0 {
+		if index, err = b.writeIndexPartitions(size); err != nil {
+			return err
+		}
+		b.properties.IndexPartitions = uint64(len(index))
+	}
+
+	meta := map[string]blockHandle{}
+	// the Bloom filter covers tombstones too, so that Lookup can find them
+	if bitsPerKey := b.opts.bloomBitsPerKey(); bitsPerKey > 0 {
+		if meta[META_FILTER], err = b.writeMetaBlock(newBloomFilter(b.hashes, bitsPerKey)); err != nil {
+			return err
+		}
+	}
+	if len(b.rangeDels) > 0 {
+		if meta[META_RANGE_DELETIONS], err = b.writeMetaBlock(encodeRangeTombstones(b.rangeDels)); err != nil {
+			return err
+		}
+	}
+	if meta[META_PROPERTIES], err = b.writeMetaBlock(b.properties.encode()); err != nil {
+		return err
+	}
+
+	ft := footer{indexEntries: uint64(len(index))}
+	if ft.metaIndex, err = b.writeMetaBlock(encodeMetaIndex(meta)); err != nil {
+		return err
+	}
+	var indexBuf []byte
+	for i := range index {
+		indexBuf = encodeIndexEntry(indexBuf, &index[i])
+	}
+	if ft.index, err = b.writeMetaBlock(indexBuf); err != nil {
+		return err
+	}
+	if _, err := b.f.Write(ft.encode()); err != nil {
+		return err
+	}
+
+	if err := b.f.Sync(); err != nil {
+		return err
+	}
+	return b.f.Close()
+}
+
+// Abandon stops writing the table and removes what was written of it. It
+// does nothing once the builder has finished.
+func (b *TableBuilder) Abandon() error {
+	if b.done {
+		return nil
+	}
+	b.done = true
+	// the file may already have been closed by a failed Finish
+	b.f.Close()
+	return os.Remove(b.tmpPath)
+}
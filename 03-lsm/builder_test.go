@@ -0,0 +1,151 @@
+package table
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTableBuilder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpfile := filepath.Join(dir, "tmpfile")
+	// a table already at the path is replaced, not appended to
+	if err := Build(tmpfile, generateSortedItems(100)); err != nil {
+		t.Fatalf("Error building Table: %v", err)
+	}
+
+	sortedItems := generateSortedItems(2000)
+	b, err := NewTableBuilder(tmpfile, nil)
+	if err != nil {
+		t.Fatalf("Error creating TableBuilder: %v", err)
+	}
+	for i, item := range sortedItems {
+		if i%5 == 0 {
+			sortedItems[i] = Item{Key: item.Key, Kind: KindTombstone}
+			err = b.AddItem(sortedItems[i])
+		} else {
+			err = b.Add(item.Key, item.Value)
+		}
+		if err != nil {
+			t.Fatalf("Error adding %q: %v", item.Key, err)
+		}
+	}
+
+	// keys have to be strictly increasing
+	last := sortedItems[len(sortedItems)-1].Key
+	for _, key := range []string{last, sortedItems[0].Key, ""} {
+		if err := b.Add(key, "value"); err == nil {
+			t.Fatalf("Expected adding %q after %q to fail", key, last)
+		}
+	}
+	if err := b.AddItem(Item{Key: last + "a", Kind: KindTombstone + 1}); err == nil {
+		t.Fatalf("Expected adding an item of unknown kind to fail")
+	}
+	// so do the sequence numbers of the versions of a key
+	if err := b.AddItem(Item{Key: last, Seq: 1}); err == nil {
+		t.Fatalf("Expected adding a newer version of %q after an older one to fail", last)
+	}
+
+	// the table only replaces the old one once it's finished
+	old, err := LoadTable(tmpfile)
+	if err != nil {
+		t.Fatalf("Error loading Table: %v", err)
+	}
+	if n := old.Properties().NumEntries; n != 100 {
+		t.Fatalf("Expected the old table to hold 100 entries until Finish, got %d", n)
+	}
+	old.Close()
+	if err := b.Finish(); err != nil {
+		t.Fatalf("Error finishing Table: %v", err)
+	}
+	if err := b.Add(last+"a", "value"); err == nil {
+		t.Fatalf("Expected adding to a finished builder to fail")
+	}
+	if err := b.Finish(); err == nil {
+		t.Fatalf("Expected finishing a builder twice to fail")
+	}
+
+	table, err := LoadTable(tmpfile)
+	if err != nil {
+		t.Fatalf("Error loading Table: %v", err)
+	}
+	defer table.Close()
+	iter, err := table.RangeScan("", "zzzzzzzzzzzzzzzzzzzz")
+	if err != nil {
+		t.Fatalf("Error creating RangeScan: %v", err)
+	}
+	var actualScan []Item
+	for ; iter.Valid(); iter.Next() {
+		actualScan = append(actualScan, iter.Item())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("Error during RangeScan: %v", err)
+	}
+	if !reflect.DeepEqual(sortedItems, actualScan) {
+		t.Fatalf("Unexpected RangeScan result")
+	}
+	checkDirContents(t, dir, "tmpfile")
+}
+
+func TestTableBuilderAbandon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpfile := filepath.Join(dir, "tmpfile")
+	b, err := NewTableBuilder(tmpfile, nil)
+	if err != nil {
+		t.Fatalf("Error creating TableBuilder: %v", err)
+	}
+	for _, item := range generateSortedItems(2000) {
+		if err := b.Add(item.Key, item.Value); err != nil {
+			t.Fatalf("Error adding %q: %v", item.Key, err)
+		}
+	}
+	if err := b.Abandon(); err != nil {
+		t.Fatalf("Error abandoning Table: %v", err)
+	}
+	if err := b.Finish(); err == nil {
+		t.Fatalf("Expected finishing an abandoned builder to fail")
+	}
+	checkDirContents(t, dir)
+
+	// a table that can't be moved into place is abandoned too
+	if err := os.MkdirAll(filepath.Join(tmpfile, "child"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = NewTableBuilder(tmpfile, nil); err != nil {
+		t.Fatalf("Error creating TableBuilder: %v", err)
+	}
+	if err := b.Add("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Finish(); err == nil {
+		t.Fatalf("Expected finishing a table whose path is a directory to fail")
+	}
+	checkDirContents(t, dir, "tmpfile")
+}
+
+func checkDirContents(t *testing.T, dir string, expected ...string) {
+	t.Helper()
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != len(expected) || (len(names) > 0 && !reflect.DeepEqual(names, expected)) {
+		t.Fatalf("Expected %v to hold %v, got %v", dir, expected, names)
+	}
+}
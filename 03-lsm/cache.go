@@ -0,0 +1,269 @@
+package table
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const CACHE_SHARDS = 16
+
+// CacheStats count how often a cache had what was asked of it.
+type CacheStats struct {
+	Hits, Misses uint64
+	// Number of bytes, or of open files, currently held.
+	Size int64
+}
+
+// Cache is an LRU cache of decoded data blocks, and of index partitions decoded
+// into their entries, that may be shared by any number of tables, so that the
+// blocks read most often stay in memory whichever table they belong to. It's split into shards with a lock each so that
+// concurrent reads rarely wait on each other.
+type Cache struct {
+	shards       [CACHE_SHARDS]cacheShard
+	hits, misses atomic.Uint64
+}
+
+// NewCache returns a cache holding up to capacity bytes of blocks.
+func NewCache(capacity int64) *Cache {
+	c := &Cache{}
+	for i := range c.shards {
+		c.shards[i].capacity = capacity / CACHE_SHARDS
+		c.shards[i].blocks = make(map[cacheKey]*list.Element)
+	}
+	return c
+}
+
+// Blocks are identified by the table they're in and their offset in it.
+// Every loaded table gets an ID of its own, so a table file that's loaded
+// again never sees the blocks cached for the previous Table.
+type cacheKey struct {
+	tableID uint64
+	offset  int64
+}
+
+var nextTableID atomic.Uint64
+
+type cacheShard struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	blocks   map[cacheKey]*list.Element
+	// most recently used first
+	lru list.List
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	value any
+	size  int64
+}
+
+func (c *Cache) shard(key cacheKey) *cacheShard {
+	h := key.tableID*0x9e3779b97f4a7c15 ^ uint64(key.offset)
+	return &c.shards[h%CACHE_SHARDS]
+}
+
+// get returns the cached block, which must not be modified. It's safe to call
+// on a nil *Cache, which never has anything.
+func (c *Cache) get(key cacheKey) (any, bool) {
+	if c == nil {
+		return nil, false
+	}
+	s := c.shard(key)
+	s.mu.Lock()
+	elem, ok := s.blocks[key]
+	if ok {
+		s.lru.MoveToFront(elem)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return elem.Value.(*cacheEntry).value, true
+}
+
+// add caches a block taking up size bytes, evicting the least recently used
+// ones to make room.
+func (c *Cache) add(key cacheKey, value any, size int64) {
+	if c == nil {
+		return
+	}
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blocks[key]; ok {
+		// another read of the same block got here first
+		return
+	}
+	s.blocks[key] = s.lru.PushFront(&cacheEntry{key, value, size})
+	s.size += size
+	for s.size > s.capacity && s.lru.Len() > 0 {
+		entry := s.lru.Remove(s.lru.Back()).(*cacheEntry)
+		delete(s.blocks, entry.key)
+		s.size -= entry.size
+	}
+}
+
+func (c *Cache) Stats() CacheStats {
+	stats := CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load()}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		stats.Size += s.size
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+// FileCache bounds how many table files are open at once, across every table
+// that shares it. A table's file is opened when it's read and closed again
+// once it's the least recently used, but never while a read or an iterator is
+// using it. That also means a table whose file has been removed stays
+// readable for the iterators that were already open on it.
+type FileCache struct {
+	mu       sync.Mutex
+	capacity int
+	// the open files, most recently used first
+	lru          list.List
+	hits, misses uint64
+}
+
+// NewFileCache returns a cache keeping up to capacity files open. More may be
+// open for a while if that many are in use at the same time.
+func NewFileCache(capacity int) *FileCache {
+	return &FileCache{capacity: capacity}
+}
+
+func (c *FileCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Hits: c.hits, Misses: c.misses, Size: int64(c.lru.Len())}
+}
+
+// evict closes the least recently used files that aren't in use until the
+// cache is back within its capacity. c.mu must be held.
+func (c *FileCache) evict() {
+	elem := c.lru.Back()
+	for c.lru.Len() > c.capacity && elem != nil {
+		prev := elem.Prev()
+		if h := elem.Value.(*fileHandle); h.refs == 0 {
+			h.closeFile()
+		}
+		elem = prev
+	}
+}
+
+// fileHandle is a table's file, which is open for as long as the table is
+// when there's no FileCache.
+type fileHandle struct {
+	path string
+	// guards the other fields; it's the FileCache's lock when there is one
+	mu    *sync.Mutex
+	files *FileCache
+	// nil while the file is closed
+	f *os.File
+	// the file mapped into memory, if it is; it's unmapped when f is closed
+	mapped []byte
+	// number of reads and iterators using f
+	refs int
+	// the handle's place in files.lru while f is open
+	elem *list.Element
+	// set once the table is closed
+	closed bool
+}
+
+// newFileHandle wraps the file a table was just loaded from.
+func newFileHandle(f *os.File, path string, files *FileCache) *fileHandle {
+	h := &fileHandle{path: path, f: f, files: files, mu: &sync.Mutex{}}
+	if files != nil {
+		h.mu = &files.mu
+		files.mu.Lock()
+		h.elem = files.lru.PushFront(h)
+		files.evict()
+		files.mu.Unlock()
+	}
+	return h
+}
+
+// acquire returns the open file, reopening it if it has been evicted. It
+// stays open until the matching release.
+func (h *fileHandle) acquire() (*os.File, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, os.ErrClosed
+	}
+	if h.files != nil {
+		if h.f != nil {
+			h.files.hits++
+			h.files.lru.MoveToFront(h.elem)
+		} else {
+			f, err := os.Open(h.path)
+			if err != nil {
+				return nil, err
+			}
+			h.files.misses++
+			h.f = f
+			h.elem = h.files.lru.PushFront(h)
+		}
+	}
+	h.refs++
+	if h.files != nil {
+		h.files.evict()
+	}
+	return h.f, nil
+}
+
+func (h *fileHandle) release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.refs--
+	if h.refs > 0 {
+		return
+	}
+	if h.closed {
+		h.closeFile()
+	} else if h.files != nil {
+		h.files.evict()
+	}
+}
+
+// close closes the file once nothing is using it any more.
+func (h *fileHandle) close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return os.ErrClosed
+	}
+	h.closed = true
+	if h.refs > 0 {
+		return nil
+	}
+	return h.closeFile()
+}
+
+// closeFile closes f and takes it out of the cache. h.mu must be held.
+func (h *fileHandle) closeFile() error {
+	if h.f == nil {
+		return nil
+	}
+	if h.files != nil {
+		h.files.lru.Remove(h.elem)
+		h.elem = nil
+	}
+	var err error
+	if h.mapped != nil {
+		err = munmap(h.mapped)
+		h.mapped = nil
+	}
+	if closeErr := h.f.Close(); err == nil {
+		err = closeErr
+	}
+	h.f = nil
+	return err
+}
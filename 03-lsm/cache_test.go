@@ -0,0 +1,146 @@
+package table
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlockCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpfile := filepath.Join(dir, "tmpfile")
+	sortedItems := generateSortedItems(2000)
+	if err := Build(tmpfile, sortedItems); err != nil {
+		t.Fatalf("Error building Table: %v", err)
+	}
+
+	cache := NewCache(1 << 20)
+	table, err := LoadTableWithOptions(tmpfile, &Options{BlockCache: cache})
+	if err != nil {
+		t.Fatalf("Error loading Table: %v", err)
+	}
+	defer table.Close()
+
+	blocks := table.Properties().DataBlocks
+	for pass := 0; pass < 2; pass++ {
+		for _, item := range sortedItems {
+			if value, ok, err := table.Get(item.Key); err != nil || !ok || value != item.Value {
+				t.Fatalf("Key %q: expected value %q, got (%q, %t, %v)", item.Key, item.Value, value, ok, err)
+			}
+		}
+		// every block is read from the file once, the first time it's needed
+		stats := cache.Stats()
+		expectedHits := uint64(pass+1)*uint64(len(sortedItems)) - blocks
+		if stats.Misses != blocks || stats.Hits != expectedHits {
+			t.Fatalf("Pass %d: expected %d hits and %d misses, got %+v", pass, expectedHits, blocks, stats)
+		}
+	}
+
+	// a cache too small for the whole table stays within its capacity
+	small := NewCache(4 * MAX_BLOCK_SIZE * CACHE_SHARDS)
+	table2, err := LoadTableWithOptions(tmpfile, &Options{BlockCache: small})
+	if err != nil {
+		t.Fatalf("Error loading Table: %v", err)
+	}
+	defer table2.Close()
+	for _, item := range sortedItems {
+		if _, _, err := table2.Get(item.Key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := small.Stats(); stats.Size > 4*MAX_BLOCK_SIZE*CACHE_SHARDS || stats.Size == 0 {
+		t.Fatalf("Unexpected size for a cache of %d bytes: %+v", 4*MAX_BLOCK_SIZE*CACHE_SHARDS, stats)
+	}
+}
+
+func TestFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := NewFileCache(2)
+	opts := &Options{FileCache: files}
+	var tables []*Table
+	var contents [][]Item
+	for i := 0; i < 5; i++ {
+		tmpfile := filepath.Join(dir, fmt.Sprintf("table%d", i))
+		sortedItems := generateSortedItems(500)
+		if err := Build(tmpfile, sortedItems); err != nil {
+			t.Fatalf("Error building Table: %v", err)
+		}
+		table, err := LoadTableWithOptions(tmpfile, opts)
+		if err != nil {
+			t.Fatalf("Error loading Table: %v", err)
+		}
+		tables = append(tables, table)
+		contents = append(contents, sortedItems)
+	}
+	if stats := files.Stats(); stats.Size != 2 {
+		t.Fatalf("Expected 2 open files, got %+v", stats)
+	}
+
+	for round := 0; round < 2; round++ {
+		for i, table := range tables {
+			for _, item := range contents[i][:10] {
+				if value, ok, err := table.Get(item.Key); err != nil || !ok || value != item.Value {
+					t.Fatalf("Table %d: key %q: expected value %q, got (%q, %t, %v)", i, item.Key, item.Value, value, ok, err)
+				}
+			}
+		}
+	}
+	stats := files.Stats()
+	if stats.Size > 2 || stats.Hits == 0 || stats.Misses == 0 {
+		t.Fatalf("Unexpected file cache stats %+v", stats)
+	}
+
+	// an open iterator keeps its file open, even once the file has been
+	// removed, the table closed and other tables have been read
+	iter, err := tables[0].RangeScan("", "zzzzzzzzzzzzzzzzzzzz")
+	if err != nil {
+		t.Fatalf("Error creating RangeScan: %v", err)
+	}
+	if err := os.Remove(tables[0].FilePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := tables[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i, table := range tables[1:] {
+		for _, item := range contents[i+1] {
+			if _, _, err := table.Get(item.Key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	count := 0
+	for ; iter.Valid(); iter.Next() {
+		if iter.Item() != contents[0][count] {
+			t.Fatalf("RangeScan returned %v, expected %v", iter.Item(), contents[0][count])
+		}
+		count++
+	}
+	if err := iter.Err(); err != nil || count != len(contents[0]) {
+		t.Fatalf("RangeScan returned %d items, expected %d (err %v)", count, len(contents[0]), err)
+	}
+	if _, _, err := tables[0].Get(contents[0][0].Key); err == nil {
+		t.Fatalf("Expected Get on a closed table to fail")
+	}
+
+	for _, table := range tables[1:] {
+		if err := table.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := files.Stats(); stats.Size != 0 {
+		t.Fatalf("Expected every file to be closed, got %+v", stats)
+	}
+}
@@ -0,0 +1,255 @@
+package table
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Codec compresses the blocks of a table. Each block records the ID of the
+// codec it was compressed with, so a table can be read back by any program
+// that has registered the same codecs, whatever options it was written with.
+type Codec interface {
+	// ID identifies the codec in table files. 0 is reserved for blocks that
+	// aren't compressed.
+	ID() byte
+	Name() string
+	Compress(src []byte) []byte
+	Decompress(src []byte) ([]byte, error)
+}
+
+const (
+	NO_COMPRESSION_ID = 0
+	SNAPPY_ID         = 1
+)
+
+var (
+	// NoCompression stores blocks as they are.
+	NoCompression Codec = noCompression{}
+
+	// Snappy is a fast LZ77-style codec, written in the Snappy block format.
+	// It favors speed over compression ratio.
+	Snappy Codec = snappyCodec{}
+)
+
+var codecs = map[byte]Codec{
+	NO_COMPRESSION_ID: NoCompression,
+	SNAPPY_ID:         Snappy,
+}
+
+// RegisterCodec makes a codec available to Build and to the readers of the
+// tables it writes. It's meant to be called from an init function, and
+// panics if the ID is already taken.
+func RegisterCodec(c Codec) {
+	if _, ok := codecs[c.ID()]; ok {
+		panic(fmt.Sprintf("table: codec ID %d registered twice", c.ID()))
+	}
+	codecs[c.ID()] = c
+}
+
+type noCompression struct{}
+
+func (noCompression) ID() byte {
+	return NO_COMPRESSION_ID
+}
+
+func (noCompression) Name() string {
+	return "none"
+}
+
+func (noCompression) Compress(src []byte) []byte {
+	return src
+}
+
+func (noCompression) Decompress(src []byte) ([]byte, error) {
+	return src, nil
+}
+
+/*
+snappy format:
+uncompressed_length element element ... element
+
+uncompressed_length is a uvarint. Each element starts with a tag byte whose low
+two bits give its type:
+
+00 literal: the upper six bits hold length-1 when it's below 60. Otherwise
+   60, 61, 62 or 63 mean it follows in 1, 2, 3 or 4 little endian bytes.
+01 copy: bits 2-4 hold length-4 and bits 5-7 the upper three bits of the
+   offset, whose lower eight bits are the next byte.
+10 copy: the upper six bits hold length-1, and a 2 byte little endian offset
+   follows.
+11 copy: like 10, with a 4 byte offset.
+
+A copy repeats length bytes starting offset bytes back in the output.
+*/
+
+const (
+	snappyTagLiteral = 0x00
+	snappyTagCopy1   = 0x01
+	snappyTagCopy2   = 0x02
+	snappyTagCopy4   = 0x03
+
+	snappyHashBits = 14
+	// the longest offset the encoder uses, which fits a 2 byte copy
+	snappyMaxOffset = 1<<16 - 1
+	// the most output a single byte of input can expand to, reached by 3 byte
+	// copies of 64 bytes each
+	snappyMaxExpansion = 22
+)
+
+var errSnappyCorrupt = errors.New("snappy: corrupt input")
+
+type snappyCodec struct{}
+
+func (snappyCodec) ID() byte {
+	return SNAPPY_ID
+}
+
+func (snappyCodec) Name() string {
+	return "snappy"
+}
+
+// Compress looks for repeats of 4 byte sequences through a hash table of
+// where each one was last seen, and greedily extends every match it finds.
+func (snappyCodec) Compress(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+	var table [1 << snappyHashBits]int32
+	literalStart := 0
+	for i := 0; i+4 <= len(src); {
+		h := snappyHash(binary.LittleEndian.Uint32(src[i:]))
+		// positions are stored off by one, so that 0 means none
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > snappyMaxOffset ||
+			binary.LittleEndian.Uint32(src[candidate:]) != binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+		length := 4
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = appendSnappyLiteral(dst, src[literalStart:i])
+		dst = appendSnappyCopy(dst, i-candidate, length)
+		i += length
+		literalStart = i
+	}
+	return appendSnappyLiteral(dst, src[literalStart:])
+}
+
+func snappyHash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - snappyHashBits)
+}
+
+func appendSnappyLiteral(dst, literal []byte) []byte {
+	// a literal's length has to fit in 4 bytes
+	for len(literal) > 1<<32 {
+		dst = appendSnappyLiteral(dst, literal[:1<<32])
+		literal = literal[1<<32:]
+	}
+	if len(literal) == 0 {
+		return dst
+	}
+	n := uint32(len(literal) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, literal...)
+}
+
+func appendSnappyCopy(dst []byte, offset, length int) []byte {
+	// a copy holds at most 64 bytes; splitting off 60 rather than 64 when
+	// it's close keeps the remainder at 4 or more, which a 1 byte offset copy
+	// needs
+	for length >= 68 {
+		dst = append(dst, 63<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|snappyTagCopy1, byte(offset))
+}
+
+func (snappyCodec) Decompress(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 || length > uint64(len(src))*snappyMaxExpansion {
+		return nil, errSnappyCorrupt
+	}
+	src = src[n:]
+	dst := make([]byte, 0, length)
+	for len(src) > 0 {
+		tag := src[0]
+		var offset, size int
+		switch tag & 0x03 {
+		case snappyTagLiteral:
+			size = int(tag >> 2)
+			src = src[1:]
+			if size >= 60 {
+				extra := size - 59
+				if len(src) < extra {
+					return nil, errSnappyCorrupt
+				}
+				size = 0
+				for i := extra - 1; i >= 0; i-- {
+					size = size<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			size++
+			if size > len(src) || size > int(length)-len(dst) {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[:size]...)
+			src = src[size:]
+			continue
+		case snappyTagCopy1:
+			if len(src) < 2 {
+				return nil, errSnappyCorrupt
+			}
+			size = int(tag>>2&0x07) + 4
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+		case snappyTagCopy2:
+			if len(src) < 3 {
+				return nil, errSnappyCorrupt
+			}
+			size = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case snappyTagCopy4:
+			if len(src) < 5 {
+				return nil, errSnappyCorrupt
+			}
+			size = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || size > int(length)-len(dst) {
+			return nil, errSnappyCorrupt
+		}
+		// the copy may overlap the bytes it produces, so it goes a byte at a
+		// time
+		start := len(dst) - offset
+		for i := 0; i < size; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+	if uint64(len(dst)) != length {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
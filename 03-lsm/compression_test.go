@@ -0,0 +1,149 @@
+package table
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func snappyInputs() [][]byte {
+	random := make([]byte, 10000)
+	rand.Read(random)
+	var text bytes.Buffer
+	for text.Len() < 10000 {
+		text.WriteString(randomWord(3, 8))
+		text.WriteByte(' ')
+	}
+	return [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte("abcd"),
+		// copies longer than 64 bytes, which are split up
+		bytes.Repeat([]byte("a"), 1000),
+		bytes.Repeat([]byte("abcdefgh"), 100),
+		// repeats further back than a 1 byte offset reaches
+		append(append(append([]byte(nil), random[:3000]...), random[:3000]...), 'x'),
+		random,
+		text.Bytes(),
+	}
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	for _, input := range snappyInputs() {
+		compressed := Snappy.Compress(input)
+		output, err := Snappy.Decompress(compressed)
+		if err != nil {
+			t.Fatalf("Error decompressing %d bytes: %v", len(input), err)
+		}
+		if !bytes.Equal(input, output) {
+			t.Fatalf("Round trip of %d bytes returned %d different bytes", len(input), len(output))
+		}
+	}
+
+	repeated := bytes.Repeat([]byte("abcdefgh"), 100)
+	if compressed := Snappy.Compress(repeated); len(compressed) > len(repeated)/10 {
+		t.Fatalf("Expected %d repeated bytes to compress well, got %d bytes", len(repeated), len(compressed))
+	}
+}
+
+// FuzzSnappy checks that compressing any input round trips, and that
+// decompressing it as if it were compressed fails cleanly rather than
+// panicking.
+func FuzzSnappy(f *testing.F) {
+	for _, input := range snappyInputs() {
+		f.Add(input)
+		f.Add(Snappy.Compress(input))
+	}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		output, err := Snappy.Decompress(Snappy.Compress(input))
+		if err != nil || !bytes.Equal(input, output) {
+			t.Fatalf("Round trip of %d bytes failed: %v", len(input), err)
+		}
+		Snappy.Decompress(input)
+	})
+}
+
+func TestTableCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := 2000
+	compressible := generateSortedItems(n)
+	for i := range compressible {
+		compressible[i].Value = strings.Repeat(randomWord(3, 5), 10)
+	}
+	incompressible := generateSortedItems(n)
+	for i := range incompressible {
+		value := make([]byte, 40)
+		rand.Read(value)
+		incompressible[i].Value = string(value)
+	}
+
+	tests := []struct {
+		name     string
+		items    []Item
+		codec    Codec
+		minRatio float64
+		maxRatio float64
+	}{
+		{"snappy", compressible, nil, 2, 100},
+		{"none", compressible, NoCompression, 1, 1},
+		// blocks that don't shrink are stored as they are
+		{"snappy", incompressible, Snappy, 1, 1},
+	}
+	for i, test := range tests {
+		tmpfile := filepath.Join(dir, fmt.Sprintf("compression%d", i))
+		if err := BuildWithOptions(tmpfile, test.items, &Options{Compression: test.codec}); err != nil {
+			t.Fatalf("Error building Table: %v", err)
+		}
+		table, err := LoadTable(tmpfile)
+		if err != nil {
+			t.Fatalf("Error loading Table: %v", err)
+		}
+
+		properties := table.Properties()
+		ratio := properties.CompressionRatio()
+		t.Logf("Table %d: %+v, compression ratio %.2f", i, properties, ratio)
+		if properties.Compression != test.name {
+			t.Fatalf("Table %d: expected compression %q, got %q", i, test.name, properties.Compression)
+		}
+		if ratio < test.minRatio || ratio > test.maxRatio {
+			t.Fatalf("Table %d: expected compression ratio between %v and %v, got %v", i, test.minRatio, test.maxRatio, ratio)
+		}
+		if ratio == 1 && properties.CompressedBlocks != 0 {
+			t.Fatalf("Table %d: expected no compressed blocks, got %d", i, properties.CompressedBlocks)
+		}
+		if properties.DataBlocks == 0 {
+			t.Fatalf("Table %d: expected the data block count to be recorded", i)
+		}
+
+		for _, item := range test.items {
+			if value, ok, err := table.Get(item.Key); err != nil || !ok || value != item.Value {
+				t.Fatalf("Table %d: key %q: expected value %q, got (%q, %t, %v)", i, item.Key, item.Value, value, ok, err)
+			}
+		}
+		iter, err := table.RangeScan("", "zzzzzzzzzzzzzzzzzzzz")
+		if err != nil {
+			t.Fatalf("Error creating RangeScan: %v", err)
+		}
+		count := 0
+		for ; iter.Valid(); iter.Next() {
+			if iter.Item() != test.items[count] {
+				t.Fatalf("Table %d: RangeScan returned %v, expected %v", i, iter.Item(), test.items[count])
+			}
+			count++
+		}
+		if err := iter.Err(); err != nil || count != len(test.items) {
+			t.Fatalf("Table %d: RangeScan returned %d items, expected %d (err %v)", i, count, len(test.items), err)
+		}
+		table.Close()
+	}
+}
@@ -0,0 +1,51 @@
+package table
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+const CHECKSUM_SIZE = 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruption is reported, by way of a *CorruptionError, whenever a table's
+// contents don't match their checksums or can't be decoded. Use
+// errors.Is(err, ErrCorruption) to test for it.
+var ErrCorruption = errors.New("table is corrupt")
+
+// CorruptionError records where in which table the corruption was found.
+type CorruptionError struct {
+	Path   string
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%v: corruption at offset %d: %v", e.Path, e.Offset, e.Reason)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruption
+}
+
+func (t *Table) corruption(offset int64, reason string) error {
+	return &CorruptionError{Path: t.FilePath, Offset: offset, Reason: reason}
+}
+
+// appendChecksum appends the CRC32C of data to it.
+func appendChecksum(data []byte) []byte {
+	return binary.BigEndian.AppendUint32(data, crc32.Checksum(data, crcTable))
+}
+
+// checksumMatches reports whether buf ends with the CRC32C of the bytes
+// before it.
+func checksumMatches(buf []byte) bool {
+	if len(buf) < CHECKSUM_SIZE {
+		return false
+	}
+	data := buf[:len(buf)-CHECKSUM_SIZE]
+	return crc32.Checksum(data, crcTable) == binary.BigEndian.Uint32(buf[len(data):])
+}
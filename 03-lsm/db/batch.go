@@ -0,0 +1,189 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+
+	table "../../03-lsm"
+)
+
+const (
+	// kindRangeDelete marks a range tombstone in a batch, in the log and in
+	// the memtable, where its key is the start of the range and its value the
+	// end. Tables keep range tombstones apart from their entries.
+	kindRangeDelete = table.KindTombstone + 1
+
+	// Number of bytes of keys and values past which a group of concurrent
+	// writes takes in no more batches, so that the first one isn't held up
+	// for too long.
+	MAX_WRITE_GROUP_SIZE = 1024 * 1024
+)
+
+// WriteBatch collects writes to be applied together by DB.Write. The zero
+// value is an empty batch. A WriteBatch isn't safe for concurrent use.
+type WriteBatch struct {
+	items []table.Item
+}
+
+func (b *WriteBatch) Put(key, value string) {
+	b.items = append(b.items, table.Item{Key: key, Value: value})
+}
+
+// Delete records a tombstone for key; see DB.Delete.
+func (b *WriteBatch) Delete(key string) {
+	b.items = append(b.items, table.Item{Key: key, Kind: table.KindTombstone})
+}
+
+// DeleteRange records a range tombstone for [startKey, endKey]; see
+// DB.DeleteRange.
+func (b *WriteBatch) DeleteRange(startKey, endKey string) {
+	b.items = append(b.items, table.Item{Key: startKey, Value: endKey, Kind: kindRangeDelete})
+}
+
+// Len returns the number of writes in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.items)
+}
+
+// Reset empties the batch so that it can be reused.
+func (b *WriteBatch) Reset() {
+	b.items = b.items[:0]
+}
+
+// size returns the number of bytes of keys and values in the batch.
+func (b *WriteBatch) size() int {
+	size := 0
+	for _, item := range b.items {
+		size += len(item.Key) + len(item.Value)
+	}
+	return size
+}
+
+// writer is a call to Write, or to Close, waiting its turn in db.writers.
+type writer struct {
+	// nil for Close, which only waits for the writes queued before it
+	batch *WriteBatch
+	cond  sync.Cond
+	// set once the batch has been committed by the writer at the head of
+	// the queue, along with its own
+	done bool
+	err  error
+}
+
+// Write applies every write in the batch atomically. The batch is logged as a
+// single record, and its writes are given consecutive sequence numbers in the
+// order they were added, so that a later write to a key wins over an earlier
+// one. Neither reads nor recovery after a crash ever see some of them without
+// the others. The batch may be reused once Write returns.
+//
+// Concurrent writes are applied one at a time, in the order they were
+// called. While one is being logged, the ones that come in queue up behind it,
+// and are then logged together as a single record, which is only synced once.
+func (db *DB) Write(batch *WriteBatch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	for _, item := range batch.items {
+		if item.Kind == kindRangeDelete && item.Key > item.Value {
+			return fmt.Errorf("db: DeleteRange start %q is after its end %q", item.Key, item.Value)
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	w := db.enqueueWriter(batch)
+	if w.done {
+		return w.err
+	}
+	group := db.writeGroup()
+	err := db.commit(group)
+	for _, member := range group {
+		member.done, member.err = true, err
+	}
+	db.dequeueWriters(len(group))
+	return err
+}
+
+// enqueueWriter queues up a writer for batch and waits until it's at the head
+// of the queue, or done. db.mu must be held.
+func (db *DB) enqueueWriter(batch *WriteBatch) *writer {
+	w := &writer{batch: batch}
+	w.cond.L = &db.mu
+	db.writers = append(db.writers, w)
+	for !w.done && db.writers[0] != w {
+		w.cond.Wait()
+	}
+	return w
+}
+
+// dequeueWriters takes the first n writers off the queue and wakes them up,
+// along with the one that's next. db.mu must be held.
+func (db *DB) dequeueWriters(n int) {
+	for _, w := range db.writers[1:n] {
+		w.cond.Signal()
+	}
+	db.writers = db.writers[n:]
+	if len(db.writers) > 0 {
+		db.writers[0].cond.Signal()
+	}
+}
+
+// writeGroup returns the writers whose batches the one at the head of the
+// queue commits: itself, and as many of the ones queued behind it as fit in
+// MAX_WRITE_GROUP_SIZE. db.mu must be held.
+func (db *DB) writeGroup() []*writer {
+	size := 0
+	n := 0
+	for ; n < len(db.writers); n++ {
+		batch := db.writers[n].batch
+		if batch == nil || n > 0 && size+batch.size() > MAX_WRITE_GROUP_SIZE {
+			break
+		}
+		size += batch.size()
+	}
+	return db.writers[:n]
+}
+
+// commit logs the batches of group as a single record, then applies them to
+// the memtable. db.mu must be held, but it's let go of while the record is
+// appended, so that reads and other writers aren't held up by it; only the
+// writer at the head of the queue ever uses the log. A failed append may
+// leave part of a record behind, after which nothing more can be logged, so
+// it fails every later write too.
+func (db *DB) commit(group []*writer) error {
+	if db.bgErr != nil {
+		return db.bgErr
+	}
+	items := group[0].batch.items
+	if len(group) > 1 {
+		items = nil
+		for _, w := range group {
+			items = append(items, w.batch.items...)
+		}
+	}
+	seq := db.lastSequence + 1
+	log := db.log
+	db.mu.Unlock()
+	err := log.append(encodeLogRecord(seq, items))
+	db.mu.Lock()
+	if err != nil {
+		db.bgErr = err
+		return err
+	}
+	// nothing reads past lastSequence, so the writes only become visible
+	// once all of them are in the memtable
+	for i, item := range items {
+		db.mem.put(seq+uint64(i), item.Key, item.Kind, item.Value)
+		db.metrics.UserBytes += int64(len(item.Key) + len(item.Value))
+	}
+	db.lastSequence = seq + uint64(len(items)) - 1
+	db.metrics.Writes += len(group)
+	db.metrics.WriteGroups++
+	// the batches are committed whether or not the flush succeeds, so a
+	// failure is left for the writes that come after them
+	if err := db.maybeFlush(); err != nil {
+		db.bgErr = err
+	}
+	return nil
+}
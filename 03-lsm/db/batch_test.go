@@ -0,0 +1,373 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteBatch(t *testing.T) {
+	dir := tempDir(t)
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("b", "old"); err != nil {
+		t.Fatal(err)
+	}
+	before := db.Snapshot()
+	defer before.Release()
+
+	var batch WriteBatch
+	batch.Put("a", "1")
+	batch.Delete("b")
+	batch.Put("c", "1")
+	// later writes to a key in the batch win
+	batch.Put("c", "2")
+	batch.Put("d", "1")
+	batch.Delete("d")
+	if n := batch.Len(); n != 6 {
+		t.Fatalf("Expected a batch of 6 writes, got %d", n)
+	}
+	if err := db.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+	if db.lastSequence != 7 {
+		t.Fatalf("Expected the batch to take sequence numbers 2 to 7, last is %d", db.lastSequence)
+	}
+	checkContents(t, db, map[string]string{"a": "1", "c": "2"}, []string{"b", "d"})
+	checkContents(t, before, map[string]string{"b": "old"}, []string{"a", "c", "d"})
+
+	// an empty batch writes nothing
+	batch.Reset()
+	if err := db.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+	if db.lastSequence != 7 {
+		t.Fatalf("Expected an empty batch to take no sequence numbers, last is %d", db.lastSequence)
+	}
+}
+
+// TestWriteBatchRecovery crashes in the middle of logging a batch, at every
+// possible point, and checks that recovery sees either all of it or none.
+func TestWriteBatchRecovery(t *testing.T) {
+	dir := tempDir(t)
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("before", "1"); err != nil {
+		t.Fatal(err)
+	}
+	var batch WriteBatch
+	for i := 0; i < 10; i++ {
+		batch.Put(fmt.Sprintf("key%d", i), randomWord(10, 20))
+	}
+	batch.Delete("before")
+	if err := db.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+	logPath := db.logPath(db.logNums[len(db.logNums)-1])
+	crash(db)
+
+	data, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batchStart := len(data) - WAL_HEADER_SIZE - len(encodeLogRecord(2, batch.items))
+	expected := make(map[string]string)
+	for _, item := range batch.items[:10] {
+		expected[item.Key] = item.Value
+	}
+	for offset := batchStart; offset <= len(data); offset++ {
+		if err := ioutil.WriteFile(logPath, data[:offset], 0600); err != nil {
+			t.Fatal(err)
+		}
+		db, err := Open(dir, &Options{ManualCompaction: true})
+		if err != nil {
+			t.Fatalf("Log truncated at offset %d: %v", offset, err)
+		}
+		if offset < len(data) {
+			checkContents(t, db, map[string]string{"before": "1"}, []string{"key0", "key9"})
+		} else {
+			checkContents(t, db, expected, []string{"before"})
+		}
+		// recovery writes the memtable to a new log; put the old one back
+		crash(db)
+		if err := ioutil.WriteFile(logPath, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestWriteBatchAtomicity moves amounts between accounts in batches while
+// readers check through snapshots that the total never changes.
+func TestWriteBatchAtomicity(t *testing.T) {
+	dir := tempDir(t)
+	db, err := Open(dir, &Options{MemTableSize: 16 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const accounts, total = 20, 20 * 100
+	balances := make([]int, accounts)
+	var batch WriteBatch
+	for i := range balances {
+		balances[i] = total / accounts
+		batch.Put(fmt.Sprintf("account%02d", i), strconv.Itoa(balances[i]))
+	}
+	if err := db.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				s := db.Snapshot()
+				sum := 0
+				for i := 0; i < accounts; i++ {
+					value, ok, err := s.Get(fmt.Sprintf("account%02d", i))
+					if err != nil || !ok {
+						errs <- fmt.Errorf("account%02d: (%q, %t, %v)", i, value, ok, err)
+						s.Release()
+						return
+					}
+					n, _ := strconv.Atoi(value)
+					sum += n
+				}
+				s.Release()
+				if sum != total {
+					errs <- fmt.Errorf("snapshot saw a total of %d, expected %d", sum, total)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 2000; i++ {
+		from, to := i%accounts, (i*7+3)%accounts
+		amount := i % 10
+		balances[from] -= amount
+		balances[to] += amount
+		batch.Reset()
+		batch.Put(fmt.Sprintf("account%02d", from), strconv.Itoa(balances[from]))
+		batch.Put(fmt.Sprintf("account%02d", to), strconv.Itoa(balances[to]))
+		if err := db.Write(&batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// TestGroupCommit holds the head of the writers queue, as a write being
+// logged would, until several writers have queued up behind it, and checks
+// that they're then committed in as few groups as MAX_WRITE_GROUP_SIZE allows.
+func TestGroupCommit(t *testing.T) {
+	dir := tempDir(t)
+	db, err := Open(dir, &Options{MemTableSize: 16 * 1024 * 1024, ManualCompaction: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const writers = 10
+	expected := make(map[string]string)
+	// commitGroup writes a batch of two values of the given size from each
+	// writer at once, and returns the number of groups they were committed in
+	commitGroup := func(round, valueSize int) int {
+		db.mu.Lock()
+		db.enqueueWriter(nil)
+		db.mu.Unlock()
+
+		var wg sync.WaitGroup
+		errs := make(chan error, writers)
+		for i := 0; i < writers; i++ {
+			var batch WriteBatch
+			for _, prefix := range []string{"key", "other"} {
+				key := fmt.Sprintf("%s%02d", prefix, i)
+				value := strconv.Itoa(round) + strings.Repeat("x", valueSize)
+				batch.Put(key, value)
+				expected[key] = value
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := db.Write(&batch); err != nil {
+					errs <- err
+				}
+			}()
+		}
+		for {
+			db.mu.Lock()
+			queued := len(db.writers)
+			db.mu.Unlock()
+			if queued == writers+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		before := db.Metrics()
+		db.mu.Lock()
+		db.dequeueWriters(1)
+		db.mu.Unlock()
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+		after := db.Metrics()
+		if after.Writes-before.Writes != writers {
+			t.Fatalf("Expected %d writes, got %d", writers, after.Writes-before.Writes)
+		}
+		return after.WriteGroups - before.WriteGroups
+	}
+
+	if groups := commitGroup(1, 10); groups != 1 {
+		t.Fatalf("Expected small writes to be committed in a single group, got %d", groups)
+	}
+	checkContents(t, db, expected, nil)
+	// the group is logged with consecutive sequence numbers
+	entries, _ := readLog(t, db.logPath(db.logNums[0]))
+	if len(entries) != 2*writers {
+		t.Fatalf("Expected the group's %d writes in the log, found %d", 2*writers, len(entries))
+	}
+	for i, entry := range entries {
+		if entry.seq != uint64(i+1) {
+			t.Fatalf("Expected log entry %d to have sequence number %d, got %d", i, i+1, entry.seq)
+		}
+	}
+
+	// the batches from each writer, which are 2 * 200KB, fit two at a time
+	if groups := commitGroup(2, 200*1024); groups != writers/2 {
+		t.Fatalf("Expected large writes to be committed in %d groups, got %d", writers/2, groups)
+	}
+	checkContents(t, db, expected, nil)
+}
+
+// Once a log append fails, the log may end in part of a record, so every
+// later write must fail rather than be logged after it.
+func TestWriteFailureIsSticky(t *testing.T) {
+	dir := tempDir(t)
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	// make the next append fail
+	db.log.f.Close()
+	first := db.Put("b", "2")
+	if first == nil {
+		t.Fatalf("Expected a write to a closed log to fail")
+	}
+	if err := db.Put("c", "3"); err != first {
+		t.Fatalf("Expected the next write to fail with %v, got %v", first, err)
+	}
+	if err := db.Close(); err != first {
+		t.Fatalf("Expected Close to fail with %v, got %v", first, err)
+	}
+
+	db, err = Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkContents(t, db, map[string]string{"a": "1"}, []string{"b", "c"})
+}
+
+// A write whose flush fails is still committed, so it must succeed; the
+// failure is reported by the writes after it, and by Close, which still
+// closes every file.
+func TestFlushFailure(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{MemTableSize: 4 * 1024, ManualCompaction: true}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"flushed": "value"}
+	if err := db.Put("flushed", "value"); err != nil {
+		t.Fatal(err)
+	}
+	flushMemTable(t, db)
+	// the next flush starts a new log, then writes the table numbered after
+	// it, which can't be moved into place over a directory
+	blocker := db.tablePath(db.nextFileNum + 1)
+	if err := os.MkdirAll(filepath.Join(blocker, "child"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	var failed error
+	for i := 0; failed == nil; i++ {
+		if i == 1000 {
+			t.Fatalf("Expected a write to fail once the memtable was full")
+		}
+		key := fmt.Sprintf("key%04d", i)
+		value := strings.Repeat("v", 100)
+		if failed = db.Put(key, value); failed == nil {
+			expected[key] = value
+		}
+	}
+	if db.current.numTables() != 1 {
+		t.Fatalf("Expected the flush to have failed")
+	}
+	checkContents(t, db, expected, nil)
+	if err := db.Put("another", "value"); err != failed {
+		t.Fatalf("Expected the next write to fail with %v, got %v", failed, err)
+	}
+
+	fileCache := db.opts.TableOptions.FileCache
+	if fileCache.Stats().Size == 0 {
+		t.Fatalf("Expected the table to be open")
+	}
+	if err := db.Close(); err != failed {
+		t.Fatalf("Expected Close to fail with %v, got %v", failed, err)
+	}
+	if _, err := db.manifest.f.Write([]byte("x")); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("Expected Close to close the MANIFEST, got %v writing to it", err)
+	}
+	if _, err := db.log.f.Write([]byte("x")); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("Expected Close to close the log, got %v writing to it", err)
+	}
+	if open := fileCache.Stats().Size; open != 0 {
+		t.Fatalf("Expected Close to close every table, %d are open", open)
+	}
+
+	// the writes are recovered from the log
+	if err := os.RemoveAll(blocker); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkContents(t, db, expected, nil)
+}
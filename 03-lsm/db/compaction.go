@@ -0,0 +1,417 @@
+package db
+
+import (
+	"log"
+	"sort"
+
+	table "../../03-lsm"
+)
+
+const (
+	DEFAULT_L0_COMPACTION_TRIGGER = 4
+	DEFAULT_LEVEL_SIZE_RATIO      = 10
+)
+
+// CompactionStrategy decides which tables to merge, and when. The strategy
+// for a database is chosen with Options.Compaction.
+type CompactionStrategy interface {
+	// withDefaults returns a copy of the strategy with every unset setting
+	// filled in.
+	withDefaults(opts *Options) CompactionStrategy
+
+	// pickCompaction returns the next compaction to run against v, or nil if
+	// none is due. db.mu is held.
+	pickCompaction(db *DB, v *version) *compaction
+}
+
+// compaction merges its inputs into new tables in outputLevel.
+type compaction struct {
+	level       int
+	outputLevel int
+	// inputs[0] are the tables from level, inputs[1] the overlapping tables
+	// from outputLevel when it's a different level
+	inputs [2][]*tableFile
+	// sequence numbers of the snapshots that were live when the compaction
+	// was picked, in ascending order; the ones taken later see the newest
+	// version of every key in the inputs
+	snapshots []uint64
+}
+
+// isInput reports whether f is one of the tables being merged.
+func (c *compaction) isInput(f *tableFile) bool {
+	for _, files := range c.inputs {
+		for _, input := range files {
+			if input == f {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canDropTombstone reports whether a tombstone for key can be left out of the
+// output, which is the case when no table outside the compaction that may be
+// older than its inputs holds the key.
+func (c *compaction) canDropTombstone(v *version, key string) bool {
+	for _, f := range v.levels[0] {
+		if c.level == 0 && !c.isInput(f) && f.contains(key) {
+			return false
+		}
+	}
+	for level := c.outputLevel; level < MAX_LEVELS; level++ {
+		if level == 0 {
+			continue
+		}
+		if f := v.findTable(level, key); f != nil && !c.isInput(f) {
+			return false
+		}
+	}
+	return true
+}
+
+// canDropRangeTombstone is canDropTombstone for a range tombstone, which
+// can't be left out while a table outside the compaction may hold a key in its
+// range.
+func (c *compaction) canDropRangeTombstone(v *version, r table.RangeTombstone) bool {
+	for _, f := range v.levels[0] {
+		if c.level == 0 && !c.isInput(f) && f.overlaps(r.Start, r.End) {
+			return false
+		}
+	}
+	for level := c.outputLevel; level < MAX_LEVELS; level++ {
+		if level == 0 {
+			continue
+		}
+		for _, f := range v.overlapping(level, r.Start, r.End) {
+			if !c.isInput(f) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// CompactStep runs a single compaction if one is due, and reports whether it
+// did. Unless Options.ManualCompaction is set, compactions already run in the
+// background after flushes and there's no need to call this.
+func (db *DB) CompactStep() (bool, error) {
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+
+	db.mu.Lock()
+	v := db.current
+	c := db.opts.Compaction.pickCompaction(db, v)
+	if c != nil {
+		c.snapshots = db.snapshotSeqs()
+	}
+	db.mu.Unlock()
+
+	if c == nil {
+		return false, nil
+	}
+	return true, db.runCompaction(v, c)
+}
+
+// LeveledCompaction keeps every level past level 0 made of tables with
+// disjoint key ranges, each level LevelSizeRatio times larger than the one
+// before it. A key is stored at most once per level, which bounds both read
+// and space amplification at the price of rewriting data once per level.
+type LeveledCompaction struct {
+	// Number of tables in level 0 that triggers compacting them into level 1.
+	L0CompactionTrigger int
+
+	// Number of bytes level 1 may hold before it's compacted into level 2.
+	// Defaults to 10 times Options.MemTableSize.
+	BaseLevelSize int64
+
+	// How much larger each level past level 1 is than the one before it.
+	LevelSizeRatio int
+}
+
+func (l *LeveledCompaction) withDefaults(opts *Options) CompactionStrategy {
+	result := *l
+	if result.L0CompactionTrigger <= 0 {
+		result.L0CompactionTrigger = DEFAULT_L0_COMPACTION_TRIGGER
+	}
+	if result.BaseLevelSize <= 0 {
+		result.BaseLevelSize = 10 * int64(opts.MemTableSize)
+	}
+	if result.LevelSizeRatio <= 1 {
+		result.LevelSizeRatio = DEFAULT_LEVEL_SIZE_RATIO
+	}
+	return &result
+}
+
+// maxLevelSize returns the number of bytes level may hold before it's
+// compacted into the next one.
+func (l *LeveledCompaction) maxLevelSize(level int) int64 {
+	size := l.BaseLevelSize
+	for i := 1; i < level; i++ {
+		size *= int64(l.LevelSizeRatio)
+	}
+	return size
+}
+
+// Level 0 is compacted once it holds L0CompactionTrigger tables; any other
+// level once it grows past maxLevelSize, picking the level that's the furthest
+// over.
+func (l *LeveledCompaction) pickCompaction(db *DB, v *version) *compaction {
+	c := &compaction{}
+	if len(v.levels[0]) >= l.L0CompactionTrigger {
+		// level 0 tables may overlap each other, so they're all compacted
+		// together
+		c.level = 0
+		c.inputs[0] = v.levels[0]
+	} else {
+		bestScore := 1.0
+		for level := 1; level < MAX_LEVELS-1; level++ {
+			score := float64(v.levelSize(level)) / float64(l.maxLevelSize(level))
+			if score >= bestScore {
+				bestScore = score
+				c.level = level
+			}
+		}
+		if c.level == 0 {
+			return nil
+		}
+		c.inputs[0] = []*tableFile{db.pickTable(c.level, v.levels[c.level])}
+	}
+
+	c.outputLevel = c.level + 1
+	smallest, largest := keyRange(c.inputs[0])
+	c.inputs[1] = v.overlapping(c.outputLevel, smallest, largest)
+	return c
+}
+
+// pickTable chooses the table to compact out of level, cycling through the
+// key space so that every table eventually gets its turn.
+func (db *DB) pickTable(level int, files []*tableFile) *tableFile {
+	for _, f := range files {
+		if f.smallest > db.compactPointers[level] {
+			return f
+		}
+	}
+	return files[0]
+}
+
+// runCompaction merges the inputs of c, which was picked from v, into new
+// tables and installs a version in which they replace the inputs. The inputs
+// are deleted once no read is using an older version.
+func (db *DB) runCompaction(v *version, c *compaction) error {
+	// level 0 inputs are already newest first, and they're all newer than
+	// the inputs from the next level
+	var iters []table.Iterator
+	var rangeDels []table.RangeTombstone
+	for _, files := range c.inputs {
+		for _, f := range files {
+			iter, err := f.t.RangeScan(f.smallest, f.largest)
+			if err != nil {
+				for _, iter := range iters {
+					iter.Close()
+				}
+				return err
+			}
+			iters = append(iters, iter)
+			rangeDels = append(rangeDels, f.t.RangeTombstones()...)
+		}
+	}
+	iter := NewMergingIterator(iters...)
+	defer iter.Close()
+	filter := &versionFilter{snapshots: c.snapshots}
+	// the entries a range tombstone covers are dropped once every snapshot
+	// sees it, and so is the tombstone itself once no older table holds a
+	// key in its range; the rest are written out in order of their start
+	inputDels := newRangeDelSet(rangeDels)
+	var keptDels []table.RangeTombstone
+	for _, r := range rangeDels {
+		if !filter.visibleToAll(r.Seq) || !c.canDropRangeTombstone(v, r) {
+			keptDels = append(keptDels, r)
+		}
+	}
+	sort.Slice(keptDels, func(i, j int) bool { return keptDels[i].Start < keptDels[j].Start })
+
+	edit := &versionEdit{removed: make(map[int]bool)}
+	// the table being written, if any
+	var b *table.TableBuilder
+	var fileNum int
+	defer func() {
+		if b != nil {
+			b.Abandon()
+		}
+	}()
+	finishTable := func() error {
+		f, err := db.finishTable(fileNum, b)
+		b = nil
+		if err != nil {
+			return err
+		}
+		edit.added = append(edit.added, levelFile{c.outputLevel, f})
+		return nil
+	}
+
+	size := 0
+	var lastKey string
+	// the largest end of the range tombstones in the table being written,
+	// past which it may end
+	var delsEnd string
+	hasDels := false
+	startTable := func() error {
+		var err error
+		b, fileNum, err = db.createNextTable()
+		size = 0
+		hasDels = false
+		return err
+	}
+	// addRangeDels writes the range tombstones that start before limit, or
+	// all the ones left when all is set, to the table being written
+	addRangeDels := func(limit string, all bool) error {
+		for ; len(keptDels) > 0 && (all || keptDels[0].Start < limit); keptDels = keptDels[1:] {
+			if b == nil {
+				if err := startTable(); err != nil {
+					return err
+				}
+			}
+			r := keptDels[0]
+			if err := b.AddRangeTombstone(r); err != nil {
+				return err
+			}
+			if !hasDels || r.End > delsEnd {
+				delsEnd, hasDels = r.End, true
+			}
+		}
+		return nil
+	}
+
+	for ; iter.Valid(); iter.Next() {
+		item := iter.Item()
+		// versions no reader can see any more are dropped, and so is a
+		// tombstone that every snapshot sees once no older table holds the
+		// key, since the versions it hides in the inputs are dropped too
+		if !filter.visible(item) {
+			continue
+		}
+		if inputDels.covering(item.Key, filter.horizon()) > item.Seq {
+			continue
+		}
+		if item.Kind == table.KindTombstone && filter.visibleToAll(item.Seq) && c.canDropTombstone(v, item.Key) {
+			continue
+		}
+		if err := addRangeDels(item.Key, false); err != nil {
+			return err
+		}
+		// each table in level 0 stands for a whole sorted run, so the output
+		// is only split up in the other levels, and never between two
+		// versions of a key so that a read only has to look in one table,
+		// nor inside the range of a range tombstone so that the tables keep
+		// disjoint key ranges
+		if b != nil && c.outputLevel > 0 && size >= db.opts.TargetFileSize && item.Key != lastKey && (!hasDels || delsEnd < item.Key) {
+			if err := finishTable(); err != nil {
+				return err
+			}
+		}
+		if b == nil {
+			if err := startTable(); err != nil {
+				return err
+			}
+		}
+		if err := b.AddItem(item); err != nil {
+			return err
+		}
+		size += len(item.Key) + len(item.Value)
+		lastKey = item.Key
+	}
+	// stopping short would lose every key the unreadable table still held;
+	// the tables already built are left for removeObsoleteFiles
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if err := addRangeDels("", true); err != nil {
+		return err
+	}
+	if b != nil {
+		if err := finishTable(); err != nil {
+			return err
+		}
+	}
+
+	for _, files := range c.inputs {
+		for _, f := range files {
+			edit.removed[f.num] = true
+		}
+	}
+
+	// the output of a compaction holds data as recent as its newest input
+	flushNum := 0
+	for _, files := range c.inputs {
+		for _, f := range files {
+			if f.flushNum > flushNum {
+				flushNum = f.flushNum
+			}
+		}
+	}
+	for _, added := range edit.added {
+		added.f.flushNum = flushNum
+	}
+
+	db.mu.Lock()
+	if err := db.installVersion(edit); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	_, largest := keyRange(c.inputs[0])
+	db.compactPointers[c.level] = largest
+	db.metrics.Compactions++
+	for _, added := range edit.added {
+		db.metrics.CompactionBytes += added.f.size
+	}
+	db.mu.Unlock()
+	return nil
+}
+
+// maybeScheduleCompaction wakes up the background compactor. db.mu must be
+// held.
+func (db *DB) maybeScheduleCompaction() {
+	if db.compactCh == nil {
+		return
+	}
+	select {
+	case db.compactCh <- struct{}{}:
+	default:
+		// a compaction pass is already pending
+	}
+}
+
+// compactLoop runs compactions in the background until the channel is
+// closed.
+func (db *DB) compactLoop(compactCh chan struct{}) {
+	defer db.compactWg.Done()
+	for range compactCh {
+		for {
+			compacted, err := db.CompactStep()
+			if err != nil {
+				log.Printf("Background compaction of %v failed: %v", db.dir, err)
+				db.mu.Lock()
+				db.bgErr = err
+				db.mu.Unlock()
+				return
+			}
+			if !compacted {
+				break
+			}
+		}
+	}
+}
+
+// keyRange returns the smallest and largest keys across files.
+func keyRange(files []*tableFile) (string, string) {
+	smallest, largest := files[0].smallest, files[0].largest
+	for _, f := range files[1:] {
+		if f.smallest < smallest {
+			smallest = f.smallest
+		}
+		if f.largest > largest {
+			largest = f.largest
+		}
+	}
+	return smallest, largest
+}
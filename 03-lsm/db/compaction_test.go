@@ -0,0 +1,333 @@
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func flushMemTable(t *testing.T, db *DB) {
+	t.Helper()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.enqueueWriter(nil)
+	defer db.dequeueWriters(1)
+	if err := db.flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func compactAll(t *testing.T, db *DB) int {
+	t.Helper()
+	steps := 0
+	for {
+		compacted, err := db.CompactStep()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !compacted {
+			return steps
+		}
+		steps++
+	}
+}
+
+// checkLevels verifies the shape of the LSM tree once compaction has caught
+// up: level 0 is below its trigger, and every other level is sorted, free of
+// overlaps and within its size limit.
+func checkLevels(t *testing.T, db *DB) {
+	t.Helper()
+	v := db.current
+	l := db.opts.Compaction.(*LeveledCompaction)
+	if len(v.levels[0]) >= l.L0CompactionTrigger {
+		t.Fatalf("Expected fewer than %d tables in level 0, got %d", l.L0CompactionTrigger, len(v.levels[0]))
+	}
+	for level := 1; level < MAX_LEVELS; level++ {
+		files := v.levels[level]
+		for i, f := range files {
+			if f.smallest > f.largest {
+				t.Fatalf("Level %d table %d has an invalid key range [%q, %q]", level, f.num, f.smallest, f.largest)
+			}
+			if i > 0 && files[i-1].largest >= f.smallest {
+				t.Fatalf("Level %d tables %d and %d overlap", level, files[i-1].num, f.num)
+			}
+		}
+		if level < MAX_LEVELS-1 && v.levelSize(level) > l.maxLevelSize(level) {
+			t.Fatalf("Level %d holds %d bytes, more than its limit of %d", level, v.levelSize(level), l.maxLevelSize(level))
+		}
+	}
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{
+		MemTableSize: 4 * 1024,
+		Compaction: &LeveledCompaction{
+			L0CompactionTrigger: 2,
+			BaseLevelSize:       16 * 1024,
+			LevelSizeRatio:      4,
+		},
+		ManualCompaction: true,
+	}
+
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]string)
+	var deleted []string
+	steps := 0
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 500; i++ {
+			key := randomWord(3, 5)
+			if rand.Intn(5) == 0 {
+				if err := db.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+				delete(expected, key)
+				deleted = append(deleted, key)
+				continue
+			}
+			value := randomWord(10, 20)
+			if err := db.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+			expected[key] = value
+		}
+		steps += compactAll(t, db)
+		checkLevels(t, db)
+	}
+	if steps == 0 {
+		t.Fatalf("Expected some compactions to run")
+	}
+	if len(db.current.levels[2]) == 0 {
+		t.Fatalf("Expected compaction to reach level 2")
+	}
+
+	live := deleted[:0]
+	for _, key := range deleted {
+		if _, ok := expected[key]; !ok {
+			live = append(live, key)
+		}
+	}
+	deleted = live
+	checkContents(t, db, expected, deleted)
+
+	// the table set survives reopening
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	levels := db.current.levels
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for level := range levels {
+		if len(levels[level]) != len(db.current.levels[level]) {
+			t.Fatalf("Level %d: expected %d tables after reopening, got %d", level, len(levels[level]), len(db.current.levels[level]))
+		}
+	}
+	checkContents(t, db, expected, deleted)
+
+	fileNums, err := listFiles(dir, TABLE_FILE_EXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fileNums) != db.current.numTables() {
+		t.Fatalf("Expected compacted tables to be removed, found %d table files for %d tables", len(fileNums), db.current.numTables())
+	}
+}
+
+// Tombstones are dropped, along with the values they shadow, once they're
+// compacted into the bottom level.
+func TestCompactionDropsTombstones(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{
+		MemTableSize:     1024 * 1024,
+		Compaction:       &LeveledCompaction{L0CompactionTrigger: 2},
+		ManualCompaction: true,
+	}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = randomWord(5, 10)
+		if err := db.Put(keys[i], randomWord(10, 20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushMemTable(t, db)
+	for _, key := range keys {
+		if err := db.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushMemTable(t, db)
+
+	if steps := compactAll(t, db); steps != 1 {
+		t.Fatalf("Expected a single compaction, got %d", steps)
+	}
+	if n := db.current.numTables(); n != 0 {
+		t.Fatalf("Expected every entry to be dropped, %d tables remain", n)
+	}
+	checkContents(t, db, map[string]string{}, keys)
+}
+
+func TestCompactionSequenceRanges(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{
+		MemTableSize:     1024 * 1024,
+		Compaction:       &LeveledCompaction{L0CompactionTrigger: 2},
+		ManualCompaction: true,
+	}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// flushes record the writes they hold, newest table first in level 0
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key%02d", i%15), randomWord(10, 20)); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 == 9 {
+			flushMemTable(t, db)
+		}
+	}
+	for i, expected := range [][2]uint64{{11, 20}, {1, 10}} {
+		props := db.current.levels[0][i].t.Properties()
+		if actual := [2]uint64{props.SmallestSeq, props.LargestSeq}; actual != expected {
+			t.Fatalf("Level 0 table %d: expected sequence numbers %v, got %v", i, expected, actual)
+		}
+	}
+
+	// a compaction's output covers what's left of its inputs once the first
+	// writes of key00 to key04, which nothing can read any more, are dropped
+	compactAll(t, db)
+	if n := len(db.current.levels[1]); n != 1 {
+		t.Fatalf("Expected a single table in level 1, got %d", n)
+	}
+	f := db.current.levels[1][0]
+	props := f.t.Properties()
+	if actual := [2]uint64{props.SmallestSeq, props.LargestSeq}; actual != [2]uint64{6, 20} {
+		t.Fatalf("Expected sequence numbers [6 20], got %v", actual)
+	}
+	if props.NumEntries != 15 || props.SmallestKey != f.smallest || props.LargestKey != f.largest {
+		t.Fatalf("Unexpected properties %+v for a table holding [%q, %q]", props, f.smallest, f.largest)
+	}
+}
+
+func TestSizeTieredCompaction(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{
+		MemTableSize:     4 * 1024,
+		Compaction:       &SizeTieredCompaction{MinMergeWidth: 3},
+		ManualCompaction: true,
+	}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]string)
+	var deleted []string
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 500; i++ {
+			key := randomWord(3, 5)
+			if rand.Intn(5) == 0 {
+				if err := db.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+				delete(expected, key)
+				deleted = append(deleted, key)
+				continue
+			}
+			value := randomWord(10, 20)
+			if err := db.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+			expected[key] = value
+		}
+		compactAll(t, db)
+
+		// no run of MinMergeWidth similarly sized tables is left behind
+		if db.opts.Compaction.pickCompaction(db, db.current) != nil {
+			t.Fatalf("Expected compaction to have caught up")
+		}
+		for level := 1; level < MAX_LEVELS; level++ {
+			if len(db.current.levels[level]) > 0 {
+				t.Fatalf("Expected size-tiered compaction to only use level 0")
+			}
+		}
+	}
+	if db.Metrics().Compactions == 0 {
+		t.Fatalf("Expected some compactions to run")
+	}
+
+	live := deleted[:0]
+	for _, key := range deleted {
+		if _, ok := expected[key]; !ok {
+			live = append(live, key)
+		}
+	}
+	deleted = live
+	checkContents(t, db, expected, deleted)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, db, expected, deleted)
+}
+
+// Runs the same workload against both compaction strategies and reports the
+// resulting write amplification.
+func TestCompactionWriteAmplification(t *testing.T) {
+	strategies := []struct {
+		name     string
+		strategy CompactionStrategy
+	}{
+		{"leveled", &LeveledCompaction{BaseLevelSize: 32 * 1024, LevelSizeRatio: 4}},
+		{"size-tiered", &SizeTieredCompaction{}},
+	}
+	amplification := make([]float64, len(strategies))
+	for i, s := range strategies {
+		db, err := Open(tempDir(t), &Options{
+			MemTableSize:     4 * 1024,
+			Compaction:       s.strategy,
+			ManualCompaction: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := rand.New(rand.NewSource(1))
+		for j := 0; j < 50000; j++ {
+			key := fmt.Sprintf("%06d", r.Intn(20000))
+			if err := db.Put(key, fmt.Sprintf("value-%d", j)); err != nil {
+				t.Fatal(err)
+			}
+			if j%1000 == 0 {
+				compactAll(t, db)
+			}
+		}
+		compactAll(t, db)
+
+		m := db.Metrics()
+		amplification[i] = m.WriteAmplification()
+		t.Logf("%v: write amplification %.2f, %d compactions, tables per level %v", s.name, amplification[i], m.Compactions, m.TablesPerLevel)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if amplification[1] >= amplification[0] {
+		t.Fatalf("Expected size-tiered compaction to write less than leveled compaction, got %.2f vs %.2f", amplification[1], amplification[0])
+	}
+}
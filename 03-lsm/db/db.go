@@ -0,0 +1,958 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	table "../../03-lsm"
+	"../../common"
+	"../../skip_list"
+)
+
+const (
+	DEFAULT_MEMTABLE_SIZE    = 4 * 1024 * 1024
+	DEFAULT_BLOCK_CACHE_SIZE = 8 * 1024 * 1024
+	DEFAULT_MAX_OPEN_FILES   = 1000
+	TABLE_FILE_EXT           = ".table"
+	LOG_FILE_EXT             = ".log"
+	// the 0 0 that ends the key and the sequence number
+	MEM_KEY_TRAILER_SIZE = 2 + 8
+)
+
+type Options struct {
+	// Approximate number of bytes the memtable may hold before it is flushed
+	// to a new table file.
+	MemTableSize int
+
+	// Whether every write should be synced to disk before it is
+	// acknowledged. Without it, writes survive a crash of the process but
+	// not necessarily of the machine.
+	Sync bool
+
+	// How tables are merged together. Defaults to LeveledCompaction with
+	// its default settings.
+	Compaction CompactionStrategy
+
+	// Approximate size of the tables written by compactions into any level
+	// but level 0. Defaults to MemTableSize.
+	TargetFileSize int
+
+	// Options for the table files written by flushes and compactions. Its
+	// BlockCache and FileCache may be set to share them between databases.
+	TableOptions *table.Options
+
+	// Number of bytes of data blocks to keep cached in memory, unless
+	// TableOptions.BlockCache is set. Defaults to DEFAULT_BLOCK_CACHE_SIZE.
+	BlockCacheSize int64
+
+	// Number of table files to keep open at once, unless
+	// TableOptions.FileCache is set. Defaults to DEFAULT_MAX_OPEN_FILES.
+	MaxOpenFiles int
+
+	// Disables background compaction; compactions only run when CompactStep
+	// is called. Meant for tests that need to control exactly when tables are
+	// merged.
+	ManualCompaction bool
+}
+
+// DB is a log-structured merge tree: writes are buffered in an in-memory
+// skip list (the memtable) which is flushed to an immutable table file once it
+// grows past Options.MemTableSize. Reads consult the memtable first, then the
+// one being flushed if there is one, and then the table files from newest to
+// oldest.
+//
+// Every write is appended to a write-ahead log before being applied to the
+// memtable, so that the memtable can be rebuilt if the process crashes
+// before it's flushed.
+//
+// Flushed tables are organized into levels (see version) and merged together
+// by compactions, which run in the background.
+//
+// Every write is numbered with a sequence number, and stored as a new version
+// of its key. Reads see the newest version as of when they start, or as of a
+// Snapshot; older versions are dropped by flushes and compactions once no
+// snapshot can read them.
+//
+// A DB is safe for concurrent use. Reads don't wait for each other, nor for
+// writes to be logged, and concurrent writes are committed in groups (see
+// Write).
+type DB struct {
+	dir  string
+	opts Options
+
+	// mu guards every field below it
+	mu  sync.Mutex
+	mem *memTable
+	// the memtable being flushed, if any, which holds the writes made before
+	// the ones in mem
+	imm *memTable
+	// writes waiting to be committed, in the order they came in; the one at
+	// the head of the queue commits its own along with the ones behind it,
+	// and is the only one to append to log, which it does without holding mu
+	writers []*writer
+	log     *walWriter
+	// numbers of the log files holding the contents of the memtable, the
+	// last of which is the one currently being written to
+	logNums []int
+	// every log numbered below logNum has been flushed to a table
+	logNum   int
+	manifest *walWriter
+	current  *version
+	// number that will be used to name the next file of any kind
+	nextFileNum int
+	// number of the most recent write
+	lastSequence uint64
+	// number of live snapshots at each sequence number
+	snapshots map[uint64]int
+	// for each level, the largest key of the last table compacted out of it
+	compactPointers [MAX_LEVELS]string
+	// nil when compaction is manual or the database is closed
+	compactCh chan struct{}
+	// error that stopped background compaction, or failed a log append or a
+	// flush; every later write fails with it
+	bgErr   error
+	metrics Metrics
+
+	// compactMu ensures only one compaction runs at a time
+	compactMu sync.Mutex
+	compactWg sync.WaitGroup
+}
+
+// Opens the database stored in dir, creating the directory if necessary.
+// A nil opts uses the default options.
+func Open(dir string, opts *Options) (*DB, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	db := &DB{
+		dir:         dir,
+		mem:         newMemTable(),
+		nextFileNum: 1,
+		snapshots:   make(map[uint64]int),
+	}
+	if opts != nil {
+		db.opts = *opts
+	}
+	if db.opts.MemTableSize <= 0 {
+		db.opts.MemTableSize = DEFAULT_MEMTABLE_SIZE
+	}
+	if db.opts.Compaction == nil {
+		db.opts.Compaction = &LeveledCompaction{}
+	}
+	db.opts.Compaction = db.opts.Compaction.withDefaults(&db.opts)
+	if db.opts.TargetFileSize <= 0 {
+		db.opts.TargetFileSize = db.opts.MemTableSize
+	}
+	if db.opts.BlockCacheSize <= 0 {
+		db.opts.BlockCacheSize = DEFAULT_BLOCK_CACHE_SIZE
+	}
+	if db.opts.MaxOpenFiles <= 0 {
+		db.opts.MaxOpenFiles = DEFAULT_MAX_OPEN_FILES
+	}
+	tableOpts := table.Options{}
+	if db.opts.TableOptions != nil {
+		tableOpts = *db.opts.TableOptions
+	}
+	if tableOpts.BlockCache == nil {
+		tableOpts.BlockCache = table.NewCache(db.opts.BlockCacheSize)
+	}
+	if tableOpts.FileCache == nil {
+		tableOpts.FileCache = table.NewFileCache(db.opts.MaxOpenFiles)
+	}
+	db.opts.TableOptions = &tableOpts
+
+	manifestComplete, err := db.recover()
+	if err != nil {
+		return nil, err
+	}
+
+	// rebuild the memtable from the logs that haven't been flushed yet; they
+	// are kept around until it's flushed again
+	logNums, err := listFiles(dir, LOG_FILE_EXT)
+	if err != nil {
+		return nil, err
+	}
+	for _, logNum := range logNums {
+		if logNum < db.logNum {
+			continue
+		}
+		if _, err := replayWAL(db.logPath(logNum), db.applyLogRecord); err != nil {
+			return nil, err
+		}
+		db.logNums = append(db.logNums, logNum)
+	}
+
+	// files left behind by an interrupted flush or compaction may be newer
+	// than anything the MANIFEST knows about
+	for _, ext := range []string{TABLE_FILE_EXT, LOG_FILE_EXT} {
+		fileNums, err := listFiles(dir, ext)
+		if err != nil {
+			return nil, err
+		}
+		if n := len(fileNums); n > 0 && fileNums[n-1] >= db.nextFileNum {
+			db.nextFileNum = fileNums[n-1] + 1
+		}
+	}
+
+	if err := db.newLog(); err != nil {
+		return nil, err
+	}
+	db.logNum = db.logNums[0]
+	if err := db.newManifest(); err != nil {
+		return nil, err
+	}
+	// a MANIFEST that ends in a torn edit may have lost track of tables that
+	// are still needed, so they're only removed once one that's known to be
+	// complete has been written without them, the next time around
+	if err := db.removeObsoleteFiles(manifestComplete); err != nil {
+		return nil, err
+	}
+
+	if !db.opts.ManualCompaction {
+		db.compactCh = make(chan struct{}, 1)
+		db.compactWg.Add(1)
+		go db.compactLoop(db.compactCh)
+		db.maybeScheduleCompaction()
+	}
+
+	return db, nil
+}
+
+// Close stops background compaction and flushes the memtable so that no
+// buffered writes are lost, after which the write-ahead log is no longer
+// needed. If a background error or the flush fails, the log is kept for the
+// next Open to recover from, but every file is closed all the same. The writes already in progress are completed first; the others, and
+// every read, must not be made once Close is called.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	compactCh := db.compactCh
+	db.compactCh = nil
+	db.mu.Unlock()
+	if compactCh != nil {
+		close(compactCh)
+		db.compactWg.Wait()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.enqueueWriter(nil)
+	defer db.dequeueWriters(1)
+	// the files are closed whatever goes wrong, and the first error returned
+	err := db.bgErr
+	for err == nil && (db.imm != nil || db.mem.len() > 0) {
+		err = db.flush()
+	}
+	if closeErr := db.log.close(); err == nil {
+		err = closeErr
+	}
+	// the logs are only needed to recover what couldn't be flushed
+	if err == nil {
+		err = db.removeLogs(db.logNums)
+		db.logNums = nil
+	}
+	if closeErr := db.manifest.close(); err == nil {
+		err = closeErr
+	}
+	for _, files := range db.current.levels {
+		for _, f := range files {
+			if closeErr := f.t.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+// The second return value will be `false` when the key doesn't exist or has
+// been deleted.
+func (db *DB) Get(key string) (string, bool, error) {
+	db.mu.Lock()
+	view, seq := db.acquireView(), db.lastSequence
+	db.mu.Unlock()
+	defer view.release()
+
+	return view.get(key, seq)
+}
+
+// readView is the state of the database a read works from. It's taken under
+// db.mu, but the read itself runs without holding it, concurrently with
+// writes, flushes and compactions: a flushed memtable stays readable, and the
+// version keeps its tables from being deleted.
+type readView struct {
+	db *DB
+	// the memtables to read, newest first
+	mems []*memTable
+	v    *version
+}
+
+// acquireView returns a view of the current state, which must be released
+// once the read is done. db.mu must be held.
+func (db *DB) acquireView() readView {
+	db.current.refs++
+	mems := []*memTable{db.mem}
+	if db.imm != nil {
+		mems = append(mems, db.imm)
+	}
+	return readView{db, mems, db.current}
+}
+
+func (view readView) release() {
+	view.db.mu.Lock()
+	defer view.db.mu.Unlock()
+
+	view.db.unrefVersion(view.v)
+}
+
+// get reads key as of the write with sequence number seq.
+func (view readView) get(key string, seq uint64) (string, bool, error) {
+	// the newest range tombstone as of seq covering key in what's been
+	// searched so far; every version of key further down is older than it
+	var covered uint64
+	for _, m := range view.mems {
+		covered = max(covered, m.rangeDels().covering(key, seq))
+		if item, ok := m.get(key, seq); ok {
+			return itemValue(item, covered)
+		}
+		if covered > 0 {
+			return "", false, nil
+		}
+	}
+	// a tombstone in a newer table hides any value in the older ones, and
+	// every level is newer than the ones below it, so the first version
+	// found is the newest as of seq
+	v := view.v
+	for level, files := range v.levels {
+		if level > 0 {
+			files = nil
+			if f := v.findTable(level, key); f != nil {
+				files = []*tableFile{f}
+			}
+		}
+		for _, f := range files {
+			if !f.contains(key) {
+				continue
+			}
+			covered = max(covered, f.rangeDels.covering(key, seq))
+			item, ok, err := f.t.LookupAt(key, seq)
+			if err != nil {
+				return "", false, err
+			}
+			if ok {
+				return itemValue(item, covered)
+			}
+			if covered > 0 {
+				return "", false, nil
+			}
+		}
+	}
+	return "", false, nil
+}
+
+// itemValue returns what a read finds in the newest version of a key, given
+// the newest range tombstone covering it.
+func itemValue(item table.Item, covered uint64) (string, bool, error) {
+	if item.Kind == table.KindTombstone || item.Seq < covered {
+		return "", false, nil
+	}
+	return item.Value, true, nil
+}
+
+func (db *DB) Put(key, value string) error {
+	batch := WriteBatch{items: []table.Item{{Key: key, Value: value}}}
+	return db.Write(&batch)
+}
+
+// Delete records a tombstone for key which shadows any older value, whether
+// it lives in the memtable or in a table file.
+func (db *DB) Delete(key string) error {
+	batch := WriteBatch{items: []table.Item{{Key: key, Kind: table.KindTombstone}}}
+	return db.Write(&batch)
+}
+
+// DeleteRange deletes every key in [startKey, endKey], which are inclusive
+// like RangeScan's. However many keys the range holds, a single range
+// tombstone is recorded, and the values it shadows are only dropped by
+// compactions later on.
+func (db *DB) DeleteRange(startKey, endKey string) error {
+	var batch WriteBatch
+	batch.DeleteRange(startKey, endKey)
+	return db.Write(&batch)
+}
+
+func (db *DB) applyLogRecord(payload []byte) error {
+	items, err := decodeLogRecord(payload)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		db.mem.put(item.Seq, item.Key, item.Kind, item.Value)
+		if item.Seq > db.lastSequence {
+			db.lastSequence = item.Seq
+		}
+	}
+	return nil
+}
+
+// startKey and endKey are inclusive. The iterator starts at the first key in
+// the range, and can be moved in either direction and repositioned anywhere in
+// it. It reads as of when it was created, so writes made while it's in use
+// aren't reflected in its results. It must be closed once it's no longer
+// needed.
+func (db *DB) RangeScan(startKey, endKey string) (*Iterator, error) {
+	db.mu.Lock()
+	view, seq := db.acquireView(), db.lastSequence
+	db.mu.Unlock()
+
+	return view.rangeScan(startKey, endKey, seq)
+}
+
+// rangeScan scans the keys in [startKey, endKey] as of the write with
+// sequence number seq. The view is released when the iterator is closed, or
+// right away if it can't be created.
+func (view readView) rangeScan(startKey, endKey string, seq uint64) (*Iterator, error) {
+	var iters []table.Iterator
+	// the range tombstones that may hide something in the range as of seq
+	var rangeDels []table.RangeTombstone
+	addRangeDels := func(tombstones []table.RangeTombstone) {
+		for _, r := range tombstones {
+			if r.Seq <= seq && r.Start <= endKey && r.End >= startKey {
+				rangeDels = append(rangeDels, r)
+			}
+		}
+	}
+	for _, m := range view.mems {
+		iters = append(iters, m.rangeScan(startKey, endKey))
+		addRangeDels(m.tombstones())
+	}
+	for level := range view.v.levels {
+		for _, f := range view.v.overlapping(level, startKey, endKey) {
+			iter, err := f.t.RangeScan(startKey, endKey)
+			if err != nil {
+				for _, iter := range iters {
+					iter.Close()
+				}
+				view.release()
+				return nil, err
+			}
+			iters = append(iters, iter)
+			addRangeDels(f.t.RangeTombstones())
+		}
+	}
+	return newIterator(NewMergingIterator(iters...), seq, newRangeDelSet(rangeDels), view.release), nil
+}
+
+func (db *DB) maybeFlush() error {
+	if db.mem.size < db.opts.MemTableSize {
+		return nil
+	}
+	return db.flush()
+}
+
+// flush writes the contents of the memtable to a new level 0 table,
+// including tombstones but leaving out the versions no reader can see any
+// more. The memtable is set aside as db.imm, where reads keep finding it, and
+// a fresh memtable and log are started, so that the table can be written
+// without holding db.mu. The old logs are only removed once the MANIFEST
+// records that they've been flushed. If a flush fails, db.imm is left for the
+// log to restore when the database is next opened.
+//
+// db.mu must be held, but it's let go of while files are written, so only the
+// writer at the head of the queue may flush.
+func (db *DB) flush() error {
+	if db.imm == nil {
+		if err := db.log.close(); err != nil {
+			return err
+		}
+		if err := db.newLog(); err != nil {
+			return err
+		}
+		db.imm, db.mem = db.mem, newMemTable()
+	}
+	imm := db.imm
+	fileNum := db.nextFileNum
+	db.nextFileNum++
+	filter := &versionFilter{snapshots: db.snapshotSeqs()}
+
+	db.mu.Unlock()
+	f, err := db.writeMemTable(fileNum, imm, filter)
+	db.mu.Lock()
+	if err != nil {
+		return err
+	}
+	db.metrics.FlushBytes += f.size
+	// every log but the current one only holds writes in imm
+	current := len(db.logNums) - 1
+	edit := &versionEdit{
+		added:  []levelFile{{0, f}},
+		logNum: db.logNums[current],
+	}
+	if err := db.installVersion(edit); err != nil {
+		return err
+	}
+	db.imm = nil
+	db.maybeScheduleCompaction()
+	obsolete := db.logNums[:current]
+	db.logNums = db.logNums[current:]
+
+	// a log left behind is removed the next time the database is opened
+	db.mu.Unlock()
+	err = db.removeLogs(obsolete)
+	db.mu.Lock()
+	return err
+}
+
+// writeMemTable writes the entries of m that filter lets through to the
+// level 0 table with the given file number.
+func (db *DB) writeMemTable(fileNum int, m *memTable, filter *versionFilter) (*tableFile, error) {
+	b, err := db.createTable(fileNum)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.writeTo(b, filter); err != nil {
+		b.Abandon()
+		return nil, err
+	}
+	f, err := db.finishTable(fileNum, b)
+	if err != nil {
+		return nil, err
+	}
+	f.flushNum = fileNum
+	return f, nil
+}
+
+// createTable starts writing the table with the given file number.
+func (db *DB) createTable(fileNum int) (*table.TableBuilder, error) {
+	return table.NewTableBuilder(db.tablePath(fileNum), db.opts.TableOptions)
+}
+
+// createNextTable is createTable with a newly allocated file number, for
+// callers that don't hold db.mu.
+func (db *DB) createNextTable() (*table.TableBuilder, int, error) {
+	db.mu.Lock()
+	fileNum := db.nextFileNum
+	db.nextFileNum++
+	db.mu.Unlock()
+	b, err := db.createTable(fileNum)
+	return b, fileNum, err
+}
+
+// finishTable finishes writing the table with the given file number, which
+// must not be empty, and loads it.
+func (db *DB) finishTable(fileNum int, b *table.TableBuilder) (*tableFile, error) {
+	if err := b.Finish(); err != nil {
+		return nil, err
+	}
+	return db.loadTableFile(fileNum)
+}
+
+func (db *DB) openTableFile(fileNum int) (*tableFile, error) {
+	path := db.tablePath(fileNum)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := db.loadTable(fileNum)
+	if err != nil {
+		return nil, err
+	}
+	return &tableFile{num: fileNum, size: info.Size(), t: t, rangeDels: newRangeDelSet(t.RangeTombstones())}, nil
+}
+
+// loadTableFile loads the table with the given file number, reading its key
+// range from the table itself.
+func (db *DB) loadTableFile(fileNum int) (*tableFile, error) {
+	f, err := db.openTableFile(fileNum)
+	if err != nil {
+		return nil, err
+	}
+	props := f.t.Properties()
+	f.smallest, f.largest = props.SmallestKey, props.LargestKey
+	// the range takes in the ranges of the table's range tombstones, so that
+	// the reads and compactions they matter to find the table
+	empty := props.NumEntries == 0
+	for _, r := range f.t.RangeTombstones() {
+		if empty || r.Start < f.smallest {
+			f.smallest = r.Start
+		}
+		if empty || r.End > f.largest {
+			f.largest = r.End
+		}
+		empty = false
+	}
+	return f, nil
+}
+
+// newLog starts a new write-ahead log and makes it the current one.
+func (db *DB) newLog() error {
+	log, err := createWAL(db.logPath(db.nextFileNum), db.opts.Sync)
+	if err != nil {
+		return err
+	}
+	db.log = log
+	db.logNums = append(db.logNums, db.nextFileNum)
+	db.nextFileNum++
+	return nil
+}
+
+// removeLogs deletes the log files with the given numbers.
+func (db *DB) removeLogs(logNums []int) error {
+	for _, logNum := range logNums {
+		if err := os.Remove(db.logPath(logNum)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadTable loads a table through the database's caches.
+func (db *DB) loadTable(fileNum int) (*table.Table, error) {
+	return table.LoadTableWithOptions(db.tablePath(fileNum), db.opts.TableOptions)
+}
+
+func (db *DB) tablePath(fileNum int) string {
+	return filepath.Join(db.dir, fmt.Sprintf("%06d%s", fileNum, TABLE_FILE_EXT))
+}
+
+func (db *DB) logPath(fileNum int) string {
+	return filepath.Join(db.dir, fmt.Sprintf("%06d%s", fileNum, LOG_FILE_EXT))
+}
+
+// listFiles returns the numbers of the files in dir with the given extension
+// in ascending order, i.e. oldest first.
+func listFiles(dir, ext string) ([]int, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+	if err != nil {
+		return nil, err
+	}
+	var fileNums []int
+	for _, match := range matches {
+		var fileNum int
+		if _, err := fmt.Sscanf(filepath.Base(match), "%d"+ext, &fileNum); err != nil {
+			continue
+		}
+		fileNums = append(fileNums, fileNum)
+	}
+	sort.Ints(fileNums)
+	return fileNums, nil
+}
+
+// The skip list only holds strings, and compares its keys byte by byte, so the
+// memtable stores each version of a key under an internal key: the key with
+// every 0 byte escaped as 0 0xff and followed by 0 0, which keeps escaped keys
+// in the same order whatever follows them, then the complement of the
+// sequence number in 8 big-endian bytes, which puts newer versions first.
+func encodeMemKey(key string, seq uint64) string {
+	buf := make([]byte, 0, len(key)+MEM_KEY_TRAILER_SIZE)
+	for i := 0; i < len(key); i++ {
+		buf = append(buf, key[i])
+		if key[i] == 0 {
+			buf = append(buf, 0xff)
+		}
+	}
+	buf = append(buf, 0, 0)
+	return string(binary.BigEndian.AppendUint64(buf, ^seq))
+}
+
+func decodeMemKey(internal string) (string, uint64) {
+	buf := make([]byte, 0, len(internal)-MEM_KEY_TRAILER_SIZE)
+	i := 0
+	for ; internal[i] != 0 || internal[i+1] != 0; i++ {
+		buf = append(buf, internal[i])
+		if internal[i] == 0 {
+			i++
+		}
+	}
+	return string(buf), ^binary.BigEndian.Uint64([]byte(internal[i+2:]))
+}
+
+// The value of each entry is stored with a one byte prefix recording its
+// kind.
+func encodeMemValue(kind table.Kind, value string) string {
+	return string([]byte{byte(kind)}) + value
+}
+
+func decodeMemEntry(internal, encoded string) table.Item {
+	key, seq := decodeMemKey(internal)
+	return table.Item{Key: key, Value: encoded[1:], Kind: table.Kind(encoded[0]), Seq: seq}
+}
+
+// memTable wraps a skip list holding every version of each key written to it
+// and keeps track of its approximate size in bytes. Range tombstones are kept
+// aside, in the order they were written.
+//
+// Reads may run concurrently with each other and with put, but puts must not
+// run concurrently with each other, nor with writeTo.
+type memTable struct {
+	sl *skip_list.SkipListOC
+	// mu guards rangeTombstones and rangeDelSet
+	mu              sync.Mutex
+	rangeTombstones []table.RangeTombstone
+	// index over rangeTombstones, built when it's first needed after one is
+	// added
+	rangeDelSet *rangeDelSet
+	size        int
+	count       int
+}
+
+func newMemTable() *memTable {
+	return &memTable{sl: skip_list.NewSkipListOC()}
+}
+
+// put adds an entry, or a range tombstone over [key, value] when kind is
+// kindRangeDelete.
+func (m *memTable) put(seq uint64, key string, kind table.Kind, value string) {
+	if kind == kindRangeDelete {
+		m.mu.Lock()
+		m.rangeTombstones = append(m.rangeTombstones, table.RangeTombstone{Start: key, End: value, Seq: seq})
+		m.rangeDelSet = nil
+		m.mu.Unlock()
+		m.size += len(key) + len(value) + MEM_KEY_TRAILER_SIZE
+		m.count++
+		return
+	}
+	internal := encodeMemKey(key, seq)
+	encoded := encodeMemValue(kind, value)
+	m.size += len(internal) + len(encoded)
+	m.count++
+	m.sl.Put(internal, encoded)
+}
+
+// get returns the newest version of key as of seq. The second return value
+// reports whether the memtable has such an entry at all; the entry may be a
+// tombstone.
+func (m *memTable) get(key string, seq uint64) (table.Item, bool) {
+	// the versions of key run from encodeMemKey(key, MAX_SEQUENCE) to
+	// encodeMemKey(key, 0)
+	iter := m.sl.NewIterator(encodeMemKey(key, seq), encodeMemKey(key, 0))
+	if !iter.Valid() {
+		return table.Item{}, false
+	}
+	return decodeMemEntry(iter.Key(), iter.Value()), true
+}
+
+// rangeDels returns the index over the memtable's range tombstones.
+func (m *memTable) rangeDels() *rangeDelSet {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.rangeDelSet == nil {
+		m.rangeDelSet = newRangeDelSet(m.rangeTombstones)
+	}
+	return m.rangeDelSet
+}
+
+// tombstones returns the memtable's range tombstones in the order they were
+// written. Later puts don't change the slice.
+func (m *memTable) tombstones() []table.RangeTombstone {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.rangeTombstones
+}
+
+func (m *memTable) len() int {
+	return m.count
+}
+
+// rangeScan returns every version of the keys in [startKey, endKey].
+func (m *memTable) rangeScan(startKey, endKey string) table.Iterator {
+	return &memTableIterator{m.sl.NewIterator(encodeMemKey(startKey, table.MAX_SEQUENCE), encodeMemKey(endKey, 0))}
+}
+
+// writeTo adds the entries that filter lets through to b in order,
+// tombstones included, and every range tombstone. The entries a range
+// tombstone covers are left out once no snapshot can see them.
+func (m *memTable) writeTo(b *table.TableBuilder, filter *versionFilter) error {
+	rangeDels := m.rangeDels()
+	// nothing writes to the memtable while it's being flushed, so its nodes
+	// can be walked directly
+	for node := m.sl.FirstGE("", nil); node != nil; node = node.Next[0] {
+		item := decodeMemEntry(node.Item.Key, node.Item.Value)
+		if !filter.visible(item) || rangeDels.covering(item.Key, filter.horizon()) > item.Seq {
+			continue
+		}
+		if err := b.AddItem(item); err != nil {
+			return err
+		}
+	}
+	for _, r := range m.rangeTombstones {
+		if err := b.AddRangeTombstone(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memTableIterator adapts a skip list iterator over the memtable to the
+// table.Iterator interface, decoding each entry.
+type memTableIterator struct {
+	common.SeekableIterator
+}
+
+// Seek moves to the newest version of the first key >= key.
+func (iter *memTableIterator) Seek(key string) {
+	iter.SeekableIterator.Seek(encodeMemKey(key, table.MAX_SEQUENCE))
+}
+
+func (iter *memTableIterator) Item() table.Item {
+	return decodeMemEntry(iter.Key(), iter.Value())
+}
+
+func (iter *memTableIterator) Err() error {
+	return nil
+}
+
+func (iter *memTableIterator) Close() {}
+
+// Iterator presents the live entries of a merged stream as of a sequence
+// number: the newest version of each key written by then, unless it's a
+// tombstone or a range tombstone written by then covers it. It implements
+// common.SeekableIterator, and once Valid() == false, Err() tells whether the
+// scan reached the end of its range or stopped because a table was
+// unreadable.
+//
+// The iterator keeps the memtable and the tables it reads from until it's
+// closed, even if flushes and compactions replace them meanwhile, so it can be
+// repositioned anywhere in its range at any time. Every iterator must be
+// closed once it's no longer needed, whether or not it has reached the end of
+// its range: until then, the tables stay on disk and the ones it's positioned
+// in keep their files open.
+type Iterator struct {
+	iter      table.Iterator
+	seq       uint64
+	rangeDels *rangeDelSet
+	// gives back what the iterator reads from; nil once it's closed
+	release func()
+	// the entry the iterator is at; when moving forward, iter is at it too,
+	// and when moving backwards, iter is before every version of its key
+	item    table.Item
+	valid   bool
+	reverse bool
+}
+
+func newIterator(iter table.Iterator, seq uint64, rangeDels *rangeDelSet, release func()) *Iterator {
+	d := &Iterator{iter: iter, seq: seq, rangeDels: rangeDels, release: release}
+	d.findNext()
+	return d
+}
+
+func (d *Iterator) Next() {
+	if d.reverse {
+		d.iter.Seek(d.item.Key)
+		d.reverse = false
+	}
+	d.skipKey(d.item.Key)
+	d.findNext()
+}
+
+func (d *Iterator) Prev() {
+	if !d.reverse {
+		for d.iter.Valid() && d.iter.Item().Key == d.item.Key {
+			d.iter.Prev()
+		}
+		d.reverse = true
+	}
+	d.findPrev()
+}
+
+func (d *Iterator) Seek(key string) {
+	d.iter.Seek(key)
+	d.reverse = false
+	d.findNext()
+}
+
+func (d *Iterator) SeekToFirst() {
+	d.iter.SeekToFirst()
+	d.reverse = false
+	d.findNext()
+}
+
+func (d *Iterator) SeekToLast() {
+	d.iter.SeekToLast()
+	d.reverse = true
+	d.findPrev()
+}
+
+func (d *Iterator) Valid() bool {
+	return d.valid
+}
+
+func (d *Iterator) Key() string {
+	return d.item.Key
+}
+
+func (d *Iterator) Value() string {
+	return d.item.Value
+}
+
+func (d *Iterator) Err() error {
+	return d.iter.Err()
+}
+
+// Close lets go of everything the iterator reads from. The iterator can't be
+// used afterwards, and closing it again does nothing.
+func (d *Iterator) Close() {
+	d.valid = false
+	if d.release != nil {
+		d.iter.Close()
+		d.release()
+		d.release = nil
+	}
+}
+
+// findNext moves to the next entry that's the newest version of its key as of
+// d.seq and hasn't been deleted.
+func (d *Iterator) findNext() {
+	for d.iter.Valid() {
+		item := d.iter.Item()
+		switch {
+		case item.Seq > d.seq:
+			d.iter.Next()
+		case d.deleted(item):
+			d.skipKey(item.Key)
+		default:
+			d.item, d.valid = item, true
+			return
+		}
+	}
+	d.valid = false
+}
+
+// findPrev moves back to the previous key whose newest version as of d.seq
+// hasn't been deleted. The versions of a key come oldest first going backwards,
+// so the last one seen that's visible at d.seq is the newest.
+func (d *Iterator) findPrev() {
+	for d.iter.Valid() {
+		key := d.iter.Item().Key
+		found := false
+		for d.iter.Valid() && d.iter.Item().Key == key {
+			if item := d.iter.Item(); item.Seq <= d.seq {
+				d.item, found = item, true
+			}
+			d.iter.Prev()
+		}
+		if found && !d.deleted(d.item) {
+			d.valid = true
+			return
+		}
+	}
+	d.valid = false
+}
+
+// deleted reports whether item, the newest version of its key as of d.seq, is
+// a tombstone or covered by one.
+func (d *Iterator) deleted(item table.Item) bool {
+	return item.Kind == table.KindTombstone || d.rangeDels.covering(item.Key, d.seq) > item.Seq
+}
+
+// skipKey moves past the versions of key.
+func (d *Iterator) skipKey(key string) {
+	for d.iter.Valid() && d.iter.Item().Key == key {
+		d.iter.Next()
+	}
+}
@@ -0,0 +1,672 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	table "../../03-lsm"
+)
+
+// min and max are inclusive.
+func randomWord(min, max int) string {
+	n := min + rand.Intn(max-min+1)
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		c := rune(rand.Intn(26))
+		buf.WriteRune('a' + c)
+	}
+	return buf.String()
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// reader is implemented by DB and Snapshot.
+type reader interface {
+	Get(key string) (string, bool, error)
+	RangeScan(startKey, endKey string) (*Iterator, error)
+}
+
+// checkContents verifies that db agrees with the expected key/value pairs,
+// both via point reads and via a full RangeScan.
+func checkContents(t *testing.T, db reader, expected map[string]string, deleted []string) {
+	t.Helper()
+	for key, value := range expected {
+		actual, ok, err := db.Get(key)
+		if err != nil {
+			t.Fatalf("Error performing point read for key %q: %v", key, err)
+		}
+		if !ok {
+			t.Fatalf("Expected key %q to exist", key)
+		}
+		if actual != value {
+			t.Fatalf("Key %q: expected value %q, got %q instead", key, value, actual)
+		}
+	}
+	for _, key := range deleted {
+		if _, ok, err := db.Get(key); err != nil || ok {
+			t.Fatalf("Expected key %q not to exist (err %v)", key, err)
+		}
+	}
+
+	keys := make([]string, 0, len(expected))
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	iter, err := db.RangeScan("", "zzzzzzzzzzzzzzzzzzzz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	i := 0
+	for ; iter.Valid(); iter.Next() {
+		if i >= len(keys) {
+			t.Fatalf("RangeScan returned unexpected key %q", iter.Key())
+		}
+		if iter.Key() != keys[i] || iter.Value() != expected[keys[i]] {
+			t.Fatalf("RangeScan: expected %q=%q, got %q=%q", keys[i], expected[keys[i]], iter.Key(), iter.Value())
+		}
+		i++
+	}
+	if i != len(keys) {
+		t.Fatalf("RangeScan returned %d items, expected %d", i, len(keys))
+	}
+
+	// the same iterator, moved back over the range from its end
+	for iter.SeekToLast(); iter.Valid(); iter.Prev() {
+		i--
+		if i < 0 {
+			t.Fatalf("Reverse scan returned unexpected key %q", iter.Key())
+		}
+		if iter.Key() != keys[i] || iter.Value() != expected[keys[i]] {
+			t.Fatalf("Reverse scan: expected %q=%q, got %q=%q", keys[i], expected[keys[i]], iter.Key(), iter.Value())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != 0 {
+		t.Fatalf("Reverse scan returned %d items, expected %d", len(keys)-i, len(keys))
+	}
+}
+
+func TestDB(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{MemTableSize: 8 * 1024}
+
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]string)
+	var deleted []string
+	for i := 0; i < 5000; i++ {
+		key := randomWord(3, 6)
+		if rand.Intn(4) == 0 {
+			if err := db.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			delete(expected, key)
+			deleted = append(deleted, key)
+			continue
+		}
+		value := randomWord(10, 20)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = value
+	}
+	// keys that were deleted and then written again are live
+	live := deleted[:0]
+	for _, key := range deleted {
+		if _, ok := expected[key]; !ok {
+			live = append(live, key)
+		}
+	}
+	deleted = live
+
+	if db.current.numTables() < 2 {
+		t.Fatalf("Expected the memtable to be flushed several times, got %d tables", db.current.numTables())
+	}
+	checkContents(t, db, expected, deleted)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, db, expected, deleted)
+
+	iter, err := db.RangeScan("b", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	for ; iter.Valid(); iter.Next() {
+		if iter.Key() < "b" || iter.Key() > "c" {
+			t.Fatalf("RangeScan(%q, %q) returned out of range key %q", "b", "c", iter.Key())
+		}
+	}
+}
+
+// TestConcurrentReadsAndWrites has writers updating their own keys in
+// batches, each setting every key to the number of the round, while readers
+// check that every read sees a consistent state: a writer's keys all hold the
+// same round, which never goes back. The memtable is small so that flushes and
+// compactions run throughout. Meant to be run with -race.
+func TestConcurrentReadsAndWrites(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{MemTableSize: 8 * 1024}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, readers, keys, rounds = 4, 4, 10, 300
+	key := func(w, k int) string {
+		return fmt.Sprintf("writer%d-key%02d", w, k)
+	}
+	// the round is followed by padding, so that the memtable fills up quickly
+	value := func(round int) string {
+		return fmt.Sprintf("%06d", round) + strings.Repeat("x", 50)
+	}
+	write := func(w, round int) error {
+		var batch WriteBatch
+		for k := 0; k < keys; k++ {
+			batch.Put(key(w, k), value(round))
+		}
+		return db.Write(&batch)
+	}
+	for w := 0; w < writers; w++ {
+		if err := write(w, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errs := make(chan error, writers+readers)
+	var writersWg, readersWg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		writersWg.Add(1)
+		go func(w int) {
+			defer writersWg.Done()
+			for round := 1; round <= rounds; round++ {
+				if err := write(w, round); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	done := make(chan struct{})
+	for r := 0; r < readers; r++ {
+		readersWg.Add(1)
+		go func() {
+			defer readersWg.Done()
+			// the last round seen from each writer
+			var seen [writers]int
+			// check returns the round of a value read from writer w
+			check := func(w int, value string) (int, error) {
+				round, err := strconv.Atoi(value[:6])
+				if err != nil || value != value[:6]+strings.Repeat("x", 50) || round < seen[w] {
+					return 0, fmt.Errorf("writer %d: read %q after round %d", w, value, seen[w])
+				}
+				seen[w] = round
+				return round, nil
+			}
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				w := rand.Intn(writers)
+				switch i % 3 {
+				case 0:
+					k := rand.Intn(keys)
+					actual, ok, err := db.Get(key(w, k))
+					if err == nil && !ok {
+						err = fmt.Errorf("expected key %q to exist", key(w, k))
+					}
+					if err == nil {
+						_, err = check(w, actual)
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+				case 1, 2:
+					iter, err := db.RangeScan(key(w, 0), key(w, keys-1))
+					if err != nil {
+						errs <- err
+						return
+					}
+					var values []string
+					if i%3 == 1 {
+						for ; iter.Valid(); iter.Next() {
+							values = append(values, iter.Value())
+						}
+					} else {
+						for iter.SeekToLast(); iter.Valid(); iter.Prev() {
+							values = append(values, iter.Value())
+						}
+					}
+					err = iter.Err()
+					iter.Close()
+					if err != nil {
+						errs <- err
+						return
+					}
+					if len(values) != keys {
+						errs <- fmt.Errorf("writer %d: expected a scan of %d keys, got %d", w, keys, len(values))
+						return
+					}
+					for _, actual := range values {
+						if actual != values[0] {
+							errs <- fmt.Errorf("writer %d: scan saw both %q and %q", w, values[0], actual)
+							return
+						}
+					}
+					if _, err := check(w, values[0]); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	writersWg.Wait()
+	close(done)
+	readersWg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]string)
+	for w := 0; w < writers; w++ {
+		for k := 0; k < keys; k++ {
+			expected[key(w, k)] = value(rounds)
+		}
+	}
+	checkContents(t, db, expected, nil)
+	if m := db.Metrics(); m.Writes != writers*(rounds+1) || m.Compactions == 0 {
+		t.Fatalf("Expected %d writes and some compactions, got %+v", writers*(rounds+1), m)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkContents(t, db, expected, nil)
+}
+
+// TestDBCorruption damages a data block of a table and checks that reads
+// report it rather than returning wrong results or panicking.
+func TestDBCorruption(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{ManualCompaction: true}
+
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		keys = append(keys, key)
+		if err := db.Put(key, randomWord(10, 20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fileNums, err := listFiles(dir, TABLE_FILE_EXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fileNums) != 1 {
+		t.Fatalf("Expected a single table, got %d", len(fileNums))
+	}
+	path := db.tablePath(fileNums[0])
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first entry of the first block holds keys[0]
+	data[10] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, _, err := db.Get(keys[0]); !errors.Is(err, table.ErrCorruption) {
+		t.Fatalf("Get(%q): expected ErrCorruption, got %v", keys[0], err)
+	}
+	iter, err := db.RangeScan("", "zzz")
+	if err == nil {
+		defer iter.Close()
+		for ; iter.Valid(); iter.Next() {
+		}
+		err = iter.Err()
+	}
+	if !errors.Is(err, table.ErrCorruption) {
+		t.Fatalf("RangeScan: expected ErrCorruption, got %v", err)
+	}
+}
+
+// TestDBCaches reads back a database spread over more tables than it may keep
+// open at once, and checks that the caches take part in the reads.
+func TestDBCaches(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{
+		MemTableSize: 4 * 1024,
+		MaxOpenFiles: 2,
+		// a compaction would merge the tables back into a few
+		ManualCompaction: true,
+	}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expected := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := randomWord(3, 8)
+		value := randomWord(10, 20)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = value
+	}
+	flushMemTable(t, db)
+	if tables := db.Metrics().TablesPerLevel[0]; tables <= opts.MaxOpenFiles {
+		t.Fatalf("Expected more than %d tables, got %d", opts.MaxOpenFiles, tables)
+	}
+
+	checkContents(t, db, expected, nil)
+	before := db.Metrics()
+	checkContents(t, db, expected, nil)
+	after := db.Metrics()
+	t.Logf("block cache %+v, file cache %+v", after.BlockCache, after.FileCache)
+
+	if after.FileCache.Size > int64(opts.MaxOpenFiles) {
+		t.Fatalf("Expected at most %d open files, got %d", opts.MaxOpenFiles, after.FileCache.Size)
+	}
+	// the whole database fits in the block cache, so the second pass never
+	// reads a block from disk
+	if after.BlockCache.Misses != before.BlockCache.Misses || after.BlockCache.Hits <= before.BlockCache.Hits {
+		t.Fatalf("Expected only block cache hits in the second pass, went from %+v to %+v", before.BlockCache, after.BlockCache)
+	}
+}
+
+// TestIteratorSeek pages back through the database from a key with a single
+// iterator, then moves it around at random, while the keys it covers are
+// overwritten and deleted under it.
+func TestIteratorSeek(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{
+		MemTableSize:     1024 * 1024,
+		TargetFileSize:   4 * 1024,
+		Compaction:       &LeveledCompaction{L0CompactionTrigger: 2},
+		ManualCompaction: true,
+	}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// versions of the keys are spread across the levels and the memtable,
+	// with every third key deleted in the end
+	expected := make(map[string]string)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("key%04d", i)
+			if round == 2 && i%3 == 0 {
+				err = db.Delete(key)
+				delete(expected, key)
+			} else {
+				expected[key] = fmt.Sprintf("%v-%d", key, round)
+				err = db.Put(key, expected[key])
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if round < 2 {
+			flushMemTable(t, db)
+			compactAll(t, db)
+		}
+	}
+	keys := make([]string, 0, len(expected))
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	iter, err := db.RangeScan("key0100", "key0899")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	first := sort.SearchStrings(keys, "key0100")
+	keys = keys[first:sort.SearchStrings(keys, "key0900")]
+	// none of this is seen by the iterator
+	for i := 0; i < 1000; i += 2 {
+		key := fmt.Sprintf("key%04d", i)
+		if err := db.Put(key, "overwritten"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete(key + "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the latest keys before key0500, one page after another, all the way
+	// back to the start of the range
+	index := sort.SearchStrings(keys, "key0500")
+	if iter.Seek("key0500"); iter.Valid() {
+		iter.Prev()
+	} else {
+		iter.SeekToLast()
+	}
+	for ; iter.Valid(); iter.Prev() {
+		index--
+		if index < 0 || iter.Key() != keys[index] || iter.Value() != expected[keys[index]] {
+			t.Fatalf("Paging back: expected key %d, got %q=%q", index, iter.Key(), iter.Value())
+		}
+	}
+	if index != 0 {
+		t.Fatalf("Paging back: stopped %d keys short of the start", index)
+	}
+
+	index = -1
+	for i := 0; i < 5000; i++ {
+		switch op := rand.Intn(20); {
+		case op == 0:
+			iter.SeekToFirst()
+			index = 0
+		case op == 1:
+			iter.SeekToLast()
+			index = len(keys) - 1
+		case op == 2:
+			key := fmt.Sprintf("key%04d", rand.Intn(1100))
+			iter.Seek(key)
+			index = sort.SearchStrings(keys, key)
+		case index < 0 || index >= len(keys):
+			iter.SeekToFirst()
+			index = 0
+		case op < 11:
+			iter.Next()
+			index++
+		default:
+			iter.Prev()
+			index--
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if valid := index >= 0 && index < len(keys); iter.Valid() != valid {
+			t.Fatalf("Step %d: expected Valid() == %t at key %d", i, valid, index)
+		} else if valid && (iter.Key() != keys[index] || iter.Value() != expected[keys[index]]) {
+			t.Fatalf("Step %d: expected %q=%q, got %q=%q", i, keys[index], expected[keys[index]], iter.Key(), iter.Value())
+		}
+	}
+}
+
+// An iterator keeps the tables it reads from for as long as it's open, even
+// once compactions have replaced them, and lets go of them when it's closed,
+// whether or not it reached the end of its range.
+func TestIteratorClose(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{
+		Compaction:       &LeveledCompaction{L0CompactionTrigger: 2},
+		ManualCompaction: true,
+	}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	put := func(round int) {
+		for i := 0; i < 100; i++ {
+			if err := db.Put(fmt.Sprintf("key%03d", i), fmt.Sprint(round)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		flushMemTable(t, db)
+	}
+	put(0)
+	// an iterator that has run off the end of its range can still be
+	// repositioned after a compaction replaces its tables
+	kept, err := db.RangeScan("key000", "key099")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ; kept.Valid(); kept.Next() {
+	}
+
+	// partial scans, closed before the end of their range
+	for round := 1; round <= 20; round++ {
+		put(round)
+		iter, err := db.RangeScan("key000", "key099")
+		if err != nil {
+			t.Fatal(err)
+		}
+		iter.Seek("key050")
+		iter.Prev()
+		if !iter.Valid() || iter.Key() != "key049" || iter.Value() != fmt.Sprint(round) {
+			t.Fatalf("Expected key049=%d, got (%q, %q, %t)", round, iter.Key(), iter.Value(), iter.Valid())
+		}
+		iter.Close()
+		compactAll(t, db)
+	}
+
+	kept.SeekToLast()
+	if !kept.Valid() || kept.Key() != "key099" || kept.Value() != "0" {
+		t.Fatalf("Expected key099=0, got (%q, %q, %t, %v)", kept.Key(), kept.Value(), kept.Valid(), kept.Err())
+	}
+	kept.Close()
+
+	tableNums, err := listFiles(dir, TABLE_FILE_EXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live := db.current.numTables(); len(tableNums) != live {
+		t.Fatalf("Expected %d table files once every iterator is closed, found %d", live, len(tableNums))
+	}
+}
+
+func TestImmutableMemTable(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{ManualCompaction: true}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		expected[key] = "old"
+		if err := db.Put(key, "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// set the memtable aside as a flush does before writing it out, so
+	// that reads have to merge it with the newer one
+	db.mu.Lock()
+	db.imm, db.mem = db.mem, newMemTable()
+	db.mu.Unlock()
+
+	for i := 0; i < 100; i += 2 {
+		key := fmt.Sprintf("key%03d", i)
+		expected[key] = "new"
+		if err := db.Put(key, "new"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var deleted []string
+	if err := db.DeleteRange("key010", "key019"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 10; i < 20; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		delete(expected, key)
+		deleted = append(deleted, key)
+	}
+	checkContents(t, db, expected, deleted)
+
+	// the next flush writes out the memtable set aside first
+	flushMemTable(t, db)
+	db.mu.Lock()
+	if db.imm != nil || db.mem.len() == 0 || db.current.numTables() != 1 {
+		db.mu.Unlock()
+		t.Fatalf("Expected the flush to write out only the memtable set aside")
+	}
+	db.mu.Unlock()
+	checkContents(t, db, expected, deleted)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkContents(t, db, expected, deleted)
+}
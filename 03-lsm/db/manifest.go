@@ -0,0 +1,375 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	table "../../03-lsm"
+)
+
+const (
+	CURRENT_FILE    = "CURRENT"
+	MANIFEST_PREFIX = "MANIFEST-"
+)
+
+/*
+The MANIFEST is a log of version edits, written with the same record format as
+the write-ahead log. Replaying every edit in order yields the current version.
+Each time the database is opened a new MANIFEST is started with a single edit
+describing the whole version, and the CURRENT file is pointed at it.
+
+CURRENT file format:
+manifest_name
+
+version edit format:
+tag, field, tag, field, ...
+
+tags and the fields that follow them:
+LOG_NUMBER       log_number
+NEXT_FILE_NUMBER next_file_number
+LAST_SEQUENCE    last_sequence
+REMOVED_TABLE    file_number
+ADDED_TABLE      level, file_number, flush_number, size, smallest_key, largest_key
+
+every number is a uvarint, and keys are a uvarint length followed by the key.
+*/
+
+const (
+	tagLogNumber = iota + 1
+	tagNextFileNumber
+	tagLastSequence
+	tagRemovedTable
+	tagAddedTable
+)
+
+func encodeEdit(edit *versionEdit) []byte {
+	var buf []byte
+	if edit.logNum > 0 {
+		buf = binary.AppendUvarint(buf, tagLogNumber)
+		buf = binary.AppendUvarint(buf, uint64(edit.logNum))
+	}
+	if edit.nextFileNum > 0 {
+		buf = binary.AppendUvarint(buf, tagNextFileNumber)
+		buf = binary.AppendUvarint(buf, uint64(edit.nextFileNum))
+	}
+	if edit.lastSequence > 0 {
+		buf = binary.AppendUvarint(buf, tagLastSequence)
+		buf = binary.AppendUvarint(buf, edit.lastSequence)
+	}
+	for num := range edit.removed {
+		buf = binary.AppendUvarint(buf, tagRemovedTable)
+		buf = binary.AppendUvarint(buf, uint64(num))
+	}
+	for _, added := range edit.added {
+		f := added.f
+		buf = binary.AppendUvarint(buf, tagAddedTable)
+		buf = binary.AppendUvarint(buf, uint64(added.level))
+		buf = binary.AppendUvarint(buf, uint64(f.num))
+		buf = binary.AppendUvarint(buf, uint64(f.flushNum))
+		buf = binary.AppendUvarint(buf, uint64(f.size))
+		buf = binary.AppendUvarint(buf, uint64(len(f.smallest)))
+		buf = append(buf, f.smallest...)
+		buf = binary.AppendUvarint(buf, uint64(len(f.largest)))
+		buf = append(buf, f.largest...)
+	}
+	return buf
+}
+
+var errMalformedEdit = errors.New("malformed version edit")
+
+// editDecoder reads the fields of an encoded version edit, remembering the
+// first error it runs into.
+type editDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *editDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errMalformedEdit
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return x
+}
+
+func (d *editDecoder) key() string {
+	size := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(len(d.buf)) < size {
+		d.err = errMalformedEdit
+		return ""
+	}
+	key := string(d.buf[:size])
+	d.buf = d.buf[size:]
+	return key
+}
+
+func decodeEdit(payload []byte) (*versionEdit, error) {
+	edit := &versionEdit{removed: make(map[int]bool)}
+	d := &editDecoder{buf: payload}
+	for len(d.buf) > 0 && d.err == nil {
+		switch d.uvarint() {
+		case tagLogNumber:
+			edit.logNum = int(d.uvarint())
+		case tagNextFileNumber:
+			edit.nextFileNum = int(d.uvarint())
+		case tagLastSequence:
+			edit.lastSequence = d.uvarint()
+		case tagRemovedTable:
+			edit.removed[int(d.uvarint())] = true
+		case tagAddedTable:
+			level := int(d.uvarint())
+			f := &tableFile{}
+			f.num = int(d.uvarint())
+			f.flushNum = int(d.uvarint())
+			f.size = int64(d.uvarint())
+			f.smallest = d.key()
+			f.largest = d.key()
+			if level < 0 || level >= MAX_LEVELS {
+				return nil, errMalformedEdit
+			}
+			edit.added = append(edit.added, levelFile{level, f})
+		default:
+			return nil, errMalformedEdit
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return edit, nil
+}
+
+// recover rebuilds the current version from the MANIFEST named by the
+// CURRENT file, along with the log number, next file number and last
+// sequence number it records, and loads every live table. A database without
+// a CURRENT file is new, and starts out empty. complete reports whether every
+// edit in the MANIFEST was replayed, rather than the last one being torn.
+func (db *DB) recover() (complete bool, err error) {
+	current, err := ioutil.ReadFile(filepath.Join(db.dir, CURRENT_FILE))
+	if os.IsNotExist(err) {
+		db.setCurrent(&version{})
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	manifestName := strings.TrimSpace(string(current))
+	v := &version{}
+	complete, err = replayWAL(filepath.Join(db.dir, manifestName), func(payload []byte) error {
+		edit, err := decodeEdit(payload)
+		if err != nil {
+			return fmt.Errorf("%v: %v", manifestName, err)
+		}
+		v = v.apply(edit)
+		if edit.logNum > db.logNum {
+			db.logNum = edit.logNum
+		}
+		if edit.nextFileNum > db.nextFileNum {
+			db.nextFileNum = edit.nextFileNum
+		}
+		if edit.lastSequence > db.lastSequence {
+			db.lastSequence = edit.lastSequence
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for _, files := range v.levels {
+		for _, f := range files {
+			if f.t, err = db.loadTable(f.num); err != nil {
+				return false, err
+			}
+			f.rangeDels = newRangeDelSet(f.t.RangeTombstones())
+		}
+	}
+	db.setCurrent(v)
+	return complete, nil
+}
+
+// newManifest starts a new MANIFEST holding a snapshot of the current
+// version and points CURRENT at it, leaving the previous one to
+// removeObsoleteFiles. db.mu must be held, or the database not yet shared.
+func (db *DB) newManifest() error {
+	manifestNum := db.nextFileNum
+	db.nextFileNum++
+	manifestName := fmt.Sprintf("%v%06d", MANIFEST_PREFIX, manifestNum)
+
+	manifest, err := createWAL(filepath.Join(db.dir, manifestName), true)
+	if err != nil {
+		return err
+	}
+	snapshot := &versionEdit{
+		logNum:       db.logNum,
+		nextFileNum:  db.nextFileNum,
+		lastSequence: db.lastSequence,
+	}
+	for level, files := range db.current.levels {
+		for _, f := range files {
+			snapshot.added = append(snapshot.added, levelFile{level, f})
+		}
+	}
+	if err := manifest.append(encodeEdit(snapshot)); err != nil {
+		manifest.close()
+		return err
+	}
+	if err := writeFileAtomically(filepath.Join(db.dir, CURRENT_FILE), []byte(manifestName+"\n")); err != nil {
+		manifest.close()
+		return err
+	}
+
+	if db.manifest != nil {
+		db.manifest.close()
+	}
+	db.manifest = manifest
+	return nil
+}
+
+// installVersion applies edit to the current version, records it in the
+// MANIFEST and makes the result current. db.mu must be held.
+func (db *DB) installVersion(edit *versionEdit) error {
+	edit.nextFileNum = db.nextFileNum
+	edit.lastSequence = db.lastSequence
+	if err := db.manifest.append(encodeEdit(edit)); err != nil {
+		return err
+	}
+	db.setCurrent(db.current.apply(edit))
+	if edit.logNum > 0 {
+		db.logNum = edit.logNum
+	}
+	return nil
+}
+
+// setCurrent makes v the current version. db.mu must be held, or the
+// database not yet shared.
+func (db *DB) setCurrent(v *version) {
+	v.refs = 1
+	for _, files := range v.levels {
+		for _, f := range files {
+			f.refs++
+		}
+	}
+	if db.current != nil {
+		db.unrefVersion(db.current)
+	}
+	db.current = v
+}
+
+// unrefVersion drops a reference to v. Once nothing uses it any more, the
+// tables no other version holds are no longer part of the database and are
+// closed and deleted; iterators still reading one hold its file open until
+// they're done. db.mu must be held.
+func (db *DB) unrefVersion(v *version) {
+	if v.refs--; v.refs > 0 {
+		return
+	}
+	for _, files := range v.levels {
+		for _, f := range files {
+			if f.refs--; f.refs == 0 {
+				db.removeTable(f)
+			}
+		}
+	}
+}
+
+// removeTable closes and deletes a table that's no longer part of the
+// database. A failure is only logged, since whatever is left of the table is
+// removed by removeObsoleteFiles the next time the database is opened.
+func (db *DB) removeTable(f *tableFile) {
+	path := db.tablePath(f.num)
+	if err := os.Remove(path); err != nil {
+		log.Printf("Removing obsolete table %v failed: %v", path, err)
+	}
+	if err := f.t.Close(); err != nil {
+		log.Printf("Closing obsolete table %v failed: %v", path, err)
+	}
+}
+
+// removeObsoleteFiles deletes every file in the database directory that the
+// current state no longer refers to: tables left behind by a flush or
+// compaction that didn't complete, logs that have already been flushed and
+// old MANIFESTs. Tables are only removed if removeTables is set. db.mu must
+// be held, or the database not yet shared.
+func (db *DB) removeObsoleteFiles(removeTables bool) error {
+	live := make(map[int]bool)
+	for _, files := range db.current.levels {
+		for _, f := range files {
+			live[f.num] = true
+		}
+	}
+	current, err := ioutil.ReadFile(filepath.Join(db.dir, CURRENT_FILE))
+	if err != nil {
+		return err
+	}
+	manifestName := strings.TrimSpace(string(current))
+
+	entries, err := ioutil.ReadDir(db.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		var fileNum int
+		obsolete := false
+		switch {
+		case strings.HasSuffix(name, TABLE_FILE_EXT):
+			_, err := fmt.Sscanf(name, "%d"+TABLE_FILE_EXT, &fileNum)
+			obsolete = err == nil && removeTables && !live[fileNum]
+		case strings.HasSuffix(name, LOG_FILE_EXT):
+			_, err := fmt.Sscanf(name, "%d"+LOG_FILE_EXT, &fileNum)
+			obsolete = err == nil && fileNum < db.logNum
+		case strings.HasPrefix(name, MANIFEST_PREFIX):
+			obsolete = name != manifestName
+		case strings.HasSuffix(name, ".tmp"):
+			obsolete = true
+		}
+		if obsolete {
+			if err := os.Remove(filepath.Join(db.dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeFileAtomically replaces the file at path with data by writing it next
+// to it and renaming it over, so that a crash leaves either the old or the
+// new contents behind. The directory is synced too, so that the rename
+// itself survives a crash of the machine.
+func writeFileAtomically(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return table.SyncDir(filepath.Dir(path))
+}
@@ -0,0 +1,251 @@
+package db
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// crash abandons db without closing it, as if the process had died.
+func crash(db *DB) {
+	db.log.close()
+	db.manifest.close()
+}
+
+func TestEditEncoding(t *testing.T) {
+	edit := &versionEdit{
+		removed: map[int]bool{3: true, 7: true},
+		added: []levelFile{
+			{0, &tableFile{num: 12, flushNum: 12, size: 4096, smallest: "a", largest: "m"}},
+			{2, &tableFile{num: 13, flushNum: 9, size: 123, smallest: "", largest: "z\x00z"}},
+		},
+		logNum:       11,
+		nextFileNum:  14,
+		lastSequence: 1 << 40,
+	}
+	decoded, err := decodeEdit(encodeEdit(edit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(edit, decoded) {
+		t.Fatalf("Expected %+v, got %+v", edit, decoded)
+	}
+
+	encoded := encodeEdit(edit)
+	if _, err := decodeEdit(encoded[:len(encoded)-1]); err == nil {
+		t.Fatalf("Expected an error decoding a truncated edit")
+	}
+}
+
+func TestManifestRecovery(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{
+		MemTableSize: 4 * 1024,
+		Compaction: &LeveledCompaction{
+			L0CompactionTrigger: 2,
+			BaseLevelSize:       16 * 1024,
+			LevelSizeRatio:      4,
+		},
+		ManualCompaction: true,
+	}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]string)
+	writes := 0
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 500; i++ {
+			key := randomWord(3, 5)
+			value := randomWord(10, 20)
+			if err := db.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+			expected[key] = value
+			writes++
+		}
+		compactAll(t, db)
+	}
+	if db.current.numTables() < 2 {
+		t.Fatalf("Expected several tables, got %d", db.current.numTables())
+	}
+
+	var tablesBefore [MAX_LEVELS][]int
+	for level, files := range db.current.levels {
+		for _, f := range files {
+			tablesBefore[level] = append(tablesBefore[level], f.num)
+		}
+	}
+
+	crash(db)
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tablesAfter [MAX_LEVELS][]int
+	for level, files := range db.current.levels {
+		for _, f := range files {
+			tablesAfter[level] = append(tablesAfter[level], f.num)
+		}
+	}
+	if !reflect.DeepEqual(tablesBefore, tablesAfter) {
+		t.Fatalf("Expected tables %v after recovery, got %v", tablesBefore, tablesAfter)
+	}
+	if db.lastSequence != uint64(writes) {
+		t.Fatalf("Expected last sequence %d after recovery, got %d", writes, db.lastSequence)
+	}
+	checkContents(t, db, expected, nil)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Files left behind by a flush or compaction that never made it into the
+// MANIFEST are removed when the database is opened.
+func TestRemoveObsoleteFiles(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{MemTableSize: 4 * 1024, ManualCompaction: true}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := randomWord(3, 5)
+		value := randomWord(10, 20)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = value
+	}
+	if db.current.numTables() == 0 {
+		t.Fatalf("Expected the memtable to have been flushed")
+	}
+
+	// a half-written compaction output, a log that was already flushed and a
+	// MANIFEST that was replaced
+	orphans := []string{
+		db.tablePath(999),
+		db.logPath(db.logNum - 1),
+		filepath.Join(dir, MANIFEST_PREFIX+"000001"),
+	}
+	for _, orphan := range orphans {
+		if err := ioutil.WriteFile(orphan, []byte("garbage"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	crash(db)
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, orphan := range orphans {
+		if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+			t.Fatalf("Expected %v to have been removed", orphan)
+		}
+	}
+	if db.nextFileNum <= 999 {
+		t.Fatalf("Expected file numbers to move past orphaned files, next is %d", db.nextFileNum)
+	}
+	checkContents(t, db, expected, nil)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A MANIFEST damaged anywhere but in its last edit must keep the database
+// from opening, rather than have it lose track of its tables; and tables are
+// only removed once a complete MANIFEST leaves them out.
+func TestManifestCorruption(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{ManualCompaction: true}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 50; i++ {
+			if err := db.Put(randomWord(3, 5), randomWord(10, 20)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		flushMemTable(t, db)
+	}
+	crash(db)
+
+	current, err := ioutil.ReadFile(filepath.Join(dir, CURRENT_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestPath := filepath.Join(dir, strings.TrimSpace(string(current)))
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// starts[i] is the offset of the i'th edit
+	var starts []int
+	for offset := 0; offset < len(data); {
+		starts = append(starts, offset)
+		offset += WAL_HEADER_SIZE + int(binary.BigEndian.Uint32(data[offset+4:]))
+	}
+	if len(starts) != 21 {
+		t.Fatalf("Expected the MANIFEST to hold 21 edits, got %d", len(starts))
+	}
+	tableNums, err := listFiles(dir, TABLE_FILE_EXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tableNums) != 20 {
+		t.Fatalf("Expected 20 tables, found %v", tableNums)
+	}
+	checkTables := func(expected []int) {
+		t.Helper()
+		actual, err := listFiles(dir, TABLE_FILE_EXT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			t.Fatalf("Expected tables %v, found %v", expected, actual)
+		}
+	}
+
+	// damage the size of an edit in the middle
+	damaged := append([]byte(nil), data...)
+	damaged[starts[10]+4] ^= 0xff
+	if err := ioutil.WriteFile(manifestPath, damaged, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if db, err := Open(dir, opts); err == nil {
+		db.Close()
+		t.Fatalf("Expected opening a database with a damaged MANIFEST to fail")
+	}
+	checkTables(tableNums)
+
+	// tear the last edit, which added the last table
+	if err := ioutil.WriteFile(manifestPath, data[:len(data)-1], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.current.numTables(); n != 19 {
+		t.Fatalf("Expected 19 live tables, got %d", n)
+	}
+	checkTables(tableNums)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the MANIFEST written by the last Open is complete, and leaves it out
+	if db, err = Open(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkTables(tableNums[:19])
+}
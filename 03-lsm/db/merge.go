@@ -0,0 +1,224 @@
+package db
+
+import (
+	"container/heap"
+
+	table "../../03-lsm"
+)
+
+// MergingIterator combines any number of sorted iterators into a single
+// sorted stream, ordered by key and then from the highest sequence number
+// down, so that every version of a key is produced, newest first. When
+// several sources hold an entry for the same key and sequence number, only the
+// one from the newest source is produced and the shadowed entries are
+// skipped; that only happens with entries of old tables, which all have
+// sequence number 0. Tombstones are produced like any other entry, so that
+// callers such as compaction can tell a deleted key from a missing one.
+//
+// The sources are kept in a heap ordered by their current key, so advancing
+// costs O(log n) in the number of sources. Moving in the other direction than
+// the last move repositions every source around the current entry first, so
+// it costs a Seek per source. If any source stops with an error, so does the
+// MergingIterator, since the keys that source still held would otherwise
+// silently go missing.
+type MergingIterator struct {
+	// every source, including the ones that have run out
+	all []*mergeSource
+	// the sources still positioned in their range, past the current entry in
+	// the direction of the last move
+	sources mergeHeap
+	item    table.Item
+	valid   bool
+	err     error
+}
+
+// The sources must be ordered newest first, and each one must produce every
+// version of a key at most once. The MergingIterator starts at the smallest
+// entry the sources are positioned at.
+func NewMergingIterator(iters ...table.Iterator) *MergingIterator {
+	m := &MergingIterator{}
+	for i, iter := range iters {
+		m.all = append(m.all, &mergeSource{iter: iter, age: i})
+	}
+	m.rebuild(false)
+	m.advance()
+	return m
+}
+
+func (m *MergingIterator) Next() {
+	if m.sources.reverse {
+		// move every source to the first entry after the current one
+		cur := m.item
+		for _, source := range m.all {
+			source.iter.Seek(cur.Key)
+			for source.iter.Valid() && !entryAfter(source.iter.Item(), cur) {
+				source.iter.Next()
+			}
+		}
+		m.rebuild(false)
+	}
+	m.advance()
+}
+
+func (m *MergingIterator) Prev() {
+	if !m.sources.reverse {
+		// move every source to the last entry before the current one
+		cur := m.item
+		for _, source := range m.all {
+			source.iter.Seek(cur.Key)
+			for source.iter.Valid() && entryAfter(cur, source.iter.Item()) {
+				source.iter.Next()
+			}
+			if source.iter.Valid() {
+				source.iter.Prev()
+			} else if source.iter.Err() == nil {
+				source.iter.SeekToLast()
+			}
+		}
+		m.rebuild(true)
+	}
+	m.advance()
+}
+
+func (m *MergingIterator) Seek(key string) {
+	for _, source := range m.all {
+		source.iter.Seek(key)
+	}
+	m.rebuild(false)
+	m.advance()
+}
+
+func (m *MergingIterator) SeekToFirst() {
+	for _, source := range m.all {
+		source.iter.SeekToFirst()
+	}
+	m.rebuild(false)
+	m.advance()
+}
+
+func (m *MergingIterator) SeekToLast() {
+	for _, source := range m.all {
+		source.iter.SeekToLast()
+	}
+	m.rebuild(true)
+	m.advance()
+}
+
+func (m *MergingIterator) Valid() bool {
+	return m.valid
+}
+
+func (m *MergingIterator) Item() table.Item {
+	return m.item
+}
+
+func (m *MergingIterator) Err() error {
+	return m.err
+}
+
+// Close closes every source.
+func (m *MergingIterator) Close() {
+	m.valid = false
+	for _, source := range m.all {
+		source.iter.Close()
+	}
+}
+
+// rebuild refills the heap with the sources that are positioned in their
+// range, to be consumed in the given direction.
+func (m *MergingIterator) rebuild(reverse bool) {
+	m.err = nil
+	m.sources = mergeHeap{reverse: reverse}
+	for _, source := range m.all {
+		if err := source.iter.Err(); err != nil && m.err == nil {
+			m.err = err
+		}
+		if source.iter.Valid() {
+			source.item = source.iter.Item()
+			m.sources.sources = append(m.sources.sources, source)
+		}
+	}
+	heap.Init(&m.sources)
+}
+
+// advance takes the top entry off the heap, then moves every source
+// positioned at the same key and sequence number past it, in the heap's
+// direction, so that the shadowed entries are never produced.
+func (m *MergingIterator) advance() {
+	if m.sources.Len() == 0 || m.err != nil {
+		m.valid = false
+		return
+	}
+	m.item = m.sources.sources[0].item
+	m.valid = true
+	for m.sources.Len() > 0 && m.sources.sources[0].item.Key == m.item.Key && m.sources.sources[0].item.Seq == m.item.Seq {
+		source := m.sources.sources[0]
+		if m.sources.reverse {
+			source.iter.Prev()
+		} else {
+			source.iter.Next()
+		}
+		if source.iter.Valid() {
+			source.item = source.iter.Item()
+			heap.Fix(&m.sources, 0)
+		} else {
+			heap.Pop(&m.sources)
+			if err := source.iter.Err(); err != nil && m.err == nil {
+				m.err = err
+			}
+		}
+	}
+}
+
+// entryAfter reports whether a comes after b in a merged stream, which is
+// ordered by key and then from the highest sequence number down.
+func entryAfter(a, b table.Item) bool {
+	if a.Key != b.Key {
+		return a.Key > b.Key
+	}
+	return a.Seq < b.Seq
+}
+
+type mergeSource struct {
+	iter table.Iterator
+	// position of the source in the list passed to NewMergingIterator; lower
+	// is newer
+	age int
+	// the item iter is currently pointing to
+	item table.Item
+}
+
+// mergeHeap implements heap.Interface, ordering sources by their current key
+// and sequence number, or the other way around when reverse is set, and
+// breaking ties in favor of the newest source.
+type mergeHeap struct {
+	sources []*mergeSource
+	reverse bool
+}
+
+func (h mergeHeap) Len() int {
+	return len(h.sources)
+}
+
+func (h mergeHeap) Less(i, j int) bool {
+	a, b := h.sources[i].item, h.sources[j].item
+	if a.Key != b.Key || a.Seq != b.Seq {
+		return entryAfter(b, a) != h.reverse
+	}
+	return h.sources[i].age < h.sources[j].age
+}
+
+func (h mergeHeap) Swap(i, j int) {
+	h.sources[i], h.sources[j] = h.sources[j], h.sources[i]
+}
+
+func (h *mergeHeap) Push(x interface{}) {
+	h.sources = append(h.sources, x.(*mergeSource))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	old := h.sources
+	source := old[len(old)-1]
+	h.sources = old[:len(old)-1]
+	return source
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	table "../../03-lsm"
+)
+
+type sliceIterator struct {
+	items []table.Item
+	index int
+}
+
+func (iter *sliceIterator) Next() {
+	iter.index++
+}
+
+func (iter *sliceIterator) Prev() {
+	iter.index--
+}
+
+func (iter *sliceIterator) Seek(key string) {
+	iter.index = sort.Search(len(iter.items), func(i int) bool { return iter.items[i].Key >= key })
+}
+
+func (iter *sliceIterator) SeekToFirst() {
+	iter.index = 0
+}
+
+func (iter *sliceIterator) SeekToLast() {
+	iter.index = len(iter.items) - 1
+}
+
+func (iter *sliceIterator) Valid() bool {
+	return iter.index >= 0 && iter.index < len(iter.items)
+}
+
+func (iter *sliceIterator) Item() table.Item {
+	return iter.items[iter.index]
+}
+
+func (iter *sliceIterator) Err() error {
+	return nil
+}
+
+func (iter *sliceIterator) Close() {}
+
+func TestMergingIterator(t *testing.T) {
+	// expected holds the newest entry for every key across all sources
+	expected := make(map[string]table.Item)
+	sources := make([][]table.Item, 10)
+	// fill in the sources from oldest to newest
+	for i := len(sources) - 1; i >= 0; i-- {
+		m := make(map[string]table.Item)
+		for j := rand.Intn(200); j > 0; j-- {
+			item := table.Item{Key: randomWord(1, 3), Value: randomWord(1, 10)}
+			if rand.Intn(5) == 0 {
+				item = table.Item{Key: item.Key, Kind: table.KindTombstone}
+			}
+			m[item.Key] = item
+			expected[item.Key] = item
+		}
+		for _, item := range m {
+			sources[i] = append(sources[i], item)
+		}
+		sort.Slice(sources[i], func(a, b int) bool { return sources[i][a].Key < sources[i][b].Key })
+	}
+
+	iters := make([]table.Iterator, len(sources))
+	for i, items := range sources {
+		iters[i] = &sliceIterator{items: items}
+	}
+
+	expectedItems := make([]table.Item, 0, len(expected))
+	for _, item := range expected {
+		expectedItems = append(expectedItems, item)
+	}
+	sort.Slice(expectedItems, func(i, j int) bool { return expectedItems[i].Key < expectedItems[j].Key })
+
+	actualItems := []table.Item{}
+	for iter := NewMergingIterator(iters...); iter.Valid(); iter.Next() {
+		actualItems = append(actualItems, iter.Item())
+	}
+	if !reflect.DeepEqual(expectedItems, actualItems) {
+		t.Fatalf("Unexpected merge result\n\nExpected: %v\n\nActual: %v", expectedItems, actualItems)
+	}
+
+	if NewMergingIterator().Valid() {
+		t.Fatalf("Expected merging no sources to produce nothing")
+	}
+}
+
+// TestMergingIteratorSeek moves a merging iterator around at random, in both
+// directions, and checks that it always agrees with the merged list.
+func TestMergingIteratorSeek(t *testing.T) {
+	// versions with sequence number 0 may be in several sources, like the
+	// entries of old tables, and the newest source's is the one produced
+	type version struct {
+		key string
+		seq uint64
+	}
+	newest := make(map[version]table.Item)
+	sources := make([][]table.Item, 5)
+	for i := len(sources) - 1; i >= 0; i-- {
+		m := make(map[version]table.Item)
+		for j := rand.Intn(100); j > 0; j-- {
+			item := table.Item{Key: randomWord(1, 2), Value: randomWord(1, 10)}
+			if rand.Intn(2) == 0 {
+				item.Seq = uint64(1 + rand.Intn(1000))
+			}
+			v := version{item.Key, item.Seq}
+			m[v] = item
+			newest[v] = item
+		}
+		for _, item := range m {
+			sources[i] = append(sources[i], item)
+		}
+		sort.Slice(sources[i], func(a, b int) bool { return entryAfter(sources[i][b], sources[i][a]) })
+	}
+	var expected []table.Item
+	for _, item := range newest {
+		expected = append(expected, item)
+	}
+	sort.Slice(expected, func(a, b int) bool { return entryAfter(expected[b], expected[a]) })
+
+	iters := make([]table.Iterator, len(sources))
+	for i, items := range sources {
+		iters[i] = &sliceIterator{items: items}
+	}
+	iter := NewMergingIterator(iters...)
+	index := 0
+	for i := 0; i < 10000; i++ {
+		if valid := index >= 0 && index < len(expected); iter.Valid() != valid || valid && iter.Item() != expected[index] {
+			t.Fatalf("Step %d: expected the iterator to be at entry %d of %d", i, index, len(expected))
+		}
+		switch op := rand.Intn(20); {
+		case op == 0:
+			iter.SeekToFirst()
+			index = 0
+		case op == 1:
+			iter.SeekToLast()
+			index = len(expected) - 1
+		case op == 2:
+			key := randomWord(1, 2)
+			iter.Seek(key)
+			index = sort.Search(len(expected), func(i int) bool { return expected[i].Key >= key })
+		case !iter.Valid():
+			iter.SeekToFirst()
+			index = 0
+		case op < 11:
+			iter.Next()
+			index++
+		default:
+			iter.Prev()
+			index--
+		}
+	}
+}
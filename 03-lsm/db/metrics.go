@@ -0,0 +1,47 @@
+package db
+
+import (
+	table "../../03-lsm"
+)
+
+// Metrics describes the work a database has done since it was opened.
+type Metrics struct {
+	// Bytes of keys and values written by Put and Delete.
+	UserBytes int64
+	// Number of calls to Write, and of the groups they were committed in,
+	// each logged as a single record.
+	Writes, WriteGroups int
+	// Bytes of table files written by memtable flushes.
+	FlushBytes int64
+	// Bytes of table files written by compactions.
+	CompactionBytes int64
+	Compactions     int
+	// Number of tables in each level. Every table in level 0 may need to be
+	// checked by a read, but only one per level past it.
+	TablesPerLevel [MAX_LEVELS]int
+	// How often reads found the block or the open table file they needed in
+	// the cache.
+	BlockCache, FileCache table.CacheStats
+}
+
+// WriteAmplification is the ratio of bytes written to table files to bytes
+// written by the user.
+func (m Metrics) WriteAmplification() float64 {
+	if m.UserBytes == 0 {
+		return 0
+	}
+	return float64(m.FlushBytes+m.CompactionBytes) / float64(m.UserBytes)
+}
+
+func (db *DB) Metrics() Metrics {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	m := db.metrics
+	for level, files := range db.current.levels {
+		m.TablesPerLevel[level] = len(files)
+	}
+	m.BlockCache = db.opts.TableOptions.BlockCache.Stats()
+	m.FileCache = db.opts.TableOptions.FileCache.Stats()
+	return m
+}
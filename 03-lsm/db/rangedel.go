@@ -0,0 +1,86 @@
+package db
+
+import (
+	"sort"
+
+	table "../../03-lsm"
+)
+
+// rangeDelSet indexes range tombstones by key. Their ranges are cut up
+// wherever one of them starts or ends, into fragments that are each covered
+// by the same tombstones throughout, so that finding the ones covering a key
+// is a binary search.
+type rangeDelSet struct {
+	// sorted by start, and covering the whole span of the tombstones with no
+	// gaps; a fragment covered by none has no seqs
+	fragments []rangeDelFragment
+}
+
+// rangeDelFragment covers the keys from start up to, but not including, the
+// start of the next fragment.
+type rangeDelFragment struct {
+	start string
+	// sequence numbers of the tombstones covering the fragment, highest
+	// first
+	seqs []uint64
+}
+
+func newRangeDelSet(tombstones []table.RangeTombstone) *rangeDelSet {
+	if len(tombstones) == 0 {
+		return nil
+	}
+	// a range ends just before the key made of its end followed by a 0 byte,
+	// which is the very next key
+	byStart := append([]table.RangeTombstone(nil), tombstones...)
+	sort.Slice(byStart, func(i, j int) bool { return byStart[i].Start < byStart[j].Start })
+	byEnd := append([]table.RangeTombstone(nil), tombstones...)
+	sort.Slice(byEnd, func(i, j int) bool { return byEnd[i].End < byEnd[j].End })
+	bounds := make([]string, 0, 2*len(tombstones))
+	for _, r := range tombstones {
+		bounds = append(bounds, r.Start, r.End+"\x00")
+	}
+	sort.Strings(bounds)
+
+	s := &rangeDelSet{}
+	var active []uint64
+	i, j := 0, 0
+	for k, bound := range bounds {
+		if k > 0 && bound == bounds[k-1] {
+			continue
+		}
+		for ; i < len(byStart) && byStart[i].Start <= bound; i++ {
+			active = append(active, byStart[i].Seq)
+		}
+		for ; j < len(byEnd) && byEnd[j].End+"\x00" <= bound; j++ {
+			for a, seq := range active {
+				if seq == byEnd[j].Seq {
+					active = append(active[:a], active[a+1:]...)
+					break
+				}
+			}
+		}
+		seqs := append([]uint64(nil), active...)
+		sort.Slice(seqs, func(a, b int) bool { return seqs[a] > seqs[b] })
+		s.fragments = append(s.fragments, rangeDelFragment{start: bound, seqs: seqs})
+	}
+	return s
+}
+
+// covering returns the highest sequence number, up to seq, of a tombstone in
+// the set whose range holds key, or 0 if there's none. Whatever version of key
+// is older than it has been deleted as of seq. A nil set holds no tombstones.
+func (s *rangeDelSet) covering(key string, seq uint64) uint64 {
+	if s == nil {
+		return 0
+	}
+	i := sort.Search(len(s.fragments), func(i int) bool { return s.fragments[i].start > key }) - 1
+	if i < 0 {
+		return 0
+	}
+	for _, tombstoneSeq := range s.fragments[i].seqs {
+		if tombstoneSeq <= seq {
+			return tombstoneSeq
+		}
+	}
+	return 0
+}
@@ -0,0 +1,195 @@
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	table "../../03-lsm"
+)
+
+func TestRangeDelSet(t *testing.T) {
+	var tombstones []table.RangeTombstone
+	for i := 0; i < 50; i++ {
+		start, end := randomWord(1, 3), randomWord(1, 3)
+		if start > end {
+			start, end = end, start
+		}
+		tombstones = append(tombstones, table.RangeTombstone{Start: start, End: end, Seq: uint64(1 + rand.Intn(100))})
+	}
+	s := newRangeDelSet(tombstones)
+	for i := 0; i < 10000; i++ {
+		key, seq := randomWord(0, 4), uint64(rand.Intn(110))
+		var expected uint64
+		for _, r := range tombstones {
+			if r.Contains(key) && r.Seq <= seq && r.Seq > expected {
+				expected = r.Seq
+			}
+		}
+		if actual := s.covering(key, seq); actual != expected {
+			t.Fatalf("covering(%q, %d): expected %d, got %d", key, seq, expected, actual)
+		}
+	}
+	if newRangeDelSet(nil).covering("a", table.MAX_SEQUENCE) != 0 {
+		t.Fatalf("Expected an empty set to cover nothing")
+	}
+}
+
+// TestDeleteRange deletes ranges of keys among other writes, while snapshots
+// are taken and the memtable is flushed and compacted, and checks what the
+// database and the snapshots read, before and after reopening it.
+func TestDeleteRange(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{
+		MemTableSize:     64 * 1024,
+		TargetFileSize:   4 * 1024,
+		Compaction:       &LeveledCompaction{L0CompactionTrigger: 2, BaseLevelSize: 32 * 1024},
+		ManualCompaction: true,
+	}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make([]string, 2000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%04d", i)
+	}
+	expected := make(map[string]string)
+	var snapshots []*Snapshot
+	var contents []contentsAt
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 500; i++ {
+			key := keys[rand.Intn(len(keys))]
+			switch rand.Intn(50) {
+			case 0:
+				// ranges that start and end on keys or between them
+				first := rand.Intn(len(keys))
+				last := min(first+rand.Intn(50), len(keys)-1)
+				start, end := keys[first], keys[last]
+				if last > first && rand.Intn(2) == 0 {
+					start += "a"
+				}
+				if rand.Intn(2) == 0 {
+					end += "a"
+				}
+				if err := db.DeleteRange(start, end); err != nil {
+					t.Fatal(err)
+				}
+				for k := range expected {
+					if start <= k && k <= end {
+						delete(expected, k)
+					}
+				}
+			case 1:
+				if err := db.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+				delete(expected, key)
+			default:
+				value := fmt.Sprintf("%v-%d-%v", key, round, randomWord(10, 20))
+				if err := db.Put(key, value); err != nil {
+					t.Fatal(err)
+				}
+				expected[key] = value
+			}
+		}
+		if round%3 == 0 {
+			snapshots = append(snapshots, db.Snapshot())
+			contents = append(contents, snapshotContents(expected, keys))
+		}
+		if round%2 == 1 {
+			flushMemTable(t, db)
+			compactAll(t, db)
+			checkLevels(t, db)
+		}
+		for i, s := range snapshots {
+			checkContents(t, s, contents[i].expected, contents[i].deleted)
+		}
+		current := snapshotContents(expected, keys)
+		checkContents(t, db, current.expected, current.deleted)
+	}
+
+	// the range tombstones still in the memtable are recovered from the log
+	crash(db)
+	if db, err = Open(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	current := snapshotContents(expected, keys)
+	checkContents(t, db, current.expected, current.deleted)
+}
+
+// Range tombstones are dropped, along with the values they cover, once
+// they're compacted into the bottom level, unless a snapshot can still read
+// the values.
+func TestCompactionDropsRangeTombstones(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{
+		MemTableSize:     1024 * 1024,
+		Compaction:       &LeveledCompaction{L0CompactionTrigger: 2},
+		ManualCompaction: true,
+	}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.DeleteRange("b", "a"); err == nil {
+		t.Fatalf("Expected a range that ends before it starts to be rejected")
+	}
+
+	expected := make(map[string]string)
+	var deleted []string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		expected[key] = randomWord(10, 20)
+		if err := db.Put(key, expected[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushMemTable(t, db)
+	s := db.Snapshot()
+	if err := db.DeleteRange("key10", "key89"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 10; i < 90; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		delete(expected, key)
+		deleted = append(deleted, key)
+	}
+	flushMemTable(t, db)
+
+	// the snapshot keeps both the tombstone and what it covers
+	if steps := compactAll(t, db); steps != 1 {
+		t.Fatalf("Expected a single compaction, got %d", steps)
+	}
+	checkContents(t, db, expected, deleted)
+	props := db.current.levels[1][0].t.Properties()
+	if props.NumEntries != 100 || props.NumRangeDeletions != 1 {
+		t.Fatalf("Expected 100 entries and a range tombstone, got %+v", props)
+	}
+
+	s.Release()
+	if err := db.Put("key00", expected["key00"]); err != nil {
+		t.Fatal(err)
+	}
+	flushMemTable(t, db)
+	if err := db.Put("key99", expected["key99"]); err != nil {
+		t.Fatal(err)
+	}
+	flushMemTable(t, db)
+	compactAll(t, db)
+	checkContents(t, db, expected, deleted)
+	var entries, rangeDels uint64
+	for _, files := range db.current.levels {
+		for _, f := range files {
+			entries += f.t.Properties().NumEntries
+			rangeDels += f.t.Properties().NumRangeDeletions
+		}
+	}
+	if entries != 20 || rangeDels != 0 {
+		t.Fatalf("Expected 20 entries and no range tombstones once the snapshot was released, got %d and %d", entries, rangeDels)
+	}
+}
@@ -0,0 +1,71 @@
+package db
+
+const (
+	DEFAULT_MIN_MERGE_WIDTH = 4
+	DEFAULT_MAX_MERGE_WIDTH = 32
+	DEFAULT_BUCKET_RATIO    = 2
+)
+
+// SizeTieredCompaction keeps every table in level 0 and merges runs of
+// similarly sized tables into one larger table. Data is rewritten roughly
+// once per size tier rather than once per level, which lowers write
+// amplification, but reads have to check more tables and shadowed values
+// linger for longer.
+type SizeTieredCompaction struct {
+	// Fewest tables merged at once.
+	MinMergeWidth int
+
+	// Most tables merged at once.
+	MaxMergeWidth int
+
+	// Tables are considered similarly sized when the largest is at most
+	// BucketRatio times the size of the smallest.
+	BucketRatio float64
+}
+
+func (s *SizeTieredCompaction) withDefaults(opts *Options) CompactionStrategy {
+	result := *s
+	if result.MinMergeWidth < 2 {
+		result.MinMergeWidth = DEFAULT_MIN_MERGE_WIDTH
+	}
+	if result.MaxMergeWidth < result.MinMergeWidth {
+		result.MaxMergeWidth = DEFAULT_MAX_MERGE_WIDTH
+		if result.MaxMergeWidth < result.MinMergeWidth {
+			result.MaxMergeWidth = result.MinMergeWidth
+		}
+	}
+	if result.BucketRatio < 1 {
+		result.BucketRatio = DEFAULT_BUCKET_RATIO
+	}
+	return &result
+}
+
+// Looks for at least MinMergeWidth tables that are adjacent in level 0 and
+// similarly sized. Only adjacent tables can be merged, as the output takes
+// their place in the newest to oldest order.
+func (s *SizeTieredCompaction) pickCompaction(db *DB, v *version) *compaction {
+	files := v.levels[0]
+	for start := 0; start+s.MinMergeWidth <= len(files); start++ {
+		smallest, largest := files[start].size, files[start].size
+		end := start + 1
+		for end < len(files) && end-start < s.MaxMergeWidth {
+			size := files[end].size
+			if size < smallest {
+				smallest = size
+			}
+			if size > largest {
+				largest = size
+			}
+			if float64(largest) > s.BucketRatio*float64(smallest) {
+				break
+			}
+			end++
+		}
+		if end-start >= s.MinMergeWidth {
+			c := &compaction{level: 0, outputLevel: 0}
+			c.inputs[0] = files[start:end]
+			return c
+		}
+	}
+	return nil
+}
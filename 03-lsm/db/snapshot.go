@@ -0,0 +1,136 @@
+package db
+
+import (
+	"errors"
+	"sort"
+
+	table "../../03-lsm"
+)
+
+// ErrSnapshotReleased is returned by reads through a snapshot after it has
+// been released.
+var ErrSnapshotReleased = errors.New("db: snapshot has been released")
+
+// Snapshot is a read-only view of the database as of the moment it was
+// taken: reads through it see every write made before and none made after,
+// however much the database has been written to, flushed or compacted since.
+//
+// Each version of a key stays in the database for as long as a snapshot may
+// read it, so a snapshot should be released as soon as it's no longer needed.
+type Snapshot struct {
+	db *DB
+	// sequence number of the last write the snapshot sees
+	seq uint64
+	// guarded by db.mu
+	released bool
+}
+
+// Snapshot pins the current state of the database until the snapshot is
+// released.
+func (db *DB) Snapshot() *Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s := &Snapshot{db: db, seq: db.lastSequence}
+	db.snapshots[s.seq]++
+	return s
+}
+
+// Release lets compactions drop the versions only the snapshot could read.
+// Releasing a snapshot more than once does nothing.
+func (s *Snapshot) Release() {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if s.released {
+		return
+	}
+	s.released = true
+	if s.db.snapshots[s.seq]--; s.db.snapshots[s.seq] == 0 {
+		delete(s.db.snapshots, s.seq)
+	}
+}
+
+// Get is like DB.Get, as of when the snapshot was taken.
+func (s *Snapshot) Get(key string) (string, bool, error) {
+	s.db.mu.Lock()
+	if s.released {
+		s.db.mu.Unlock()
+		return "", false, ErrSnapshotReleased
+	}
+	view := s.db.acquireView()
+	s.db.mu.Unlock()
+	defer view.release()
+
+	return view.get(key, s.seq)
+}
+
+// RangeScan is like DB.RangeScan, as of when the snapshot was taken. The
+// iterator keeps reading as of the snapshot even if it's released.
+func (s *Snapshot) RangeScan(startKey, endKey string) (*Iterator, error) {
+	s.db.mu.Lock()
+	if s.released {
+		s.db.mu.Unlock()
+		return nil, ErrSnapshotReleased
+	}
+	view := s.db.acquireView()
+	s.db.mu.Unlock()
+
+	return view.rangeScan(startKey, endKey, s.seq)
+}
+
+// snapshotSeqs returns the sequence numbers of the live snapshots in
+// ascending order. db.mu must be held.
+func (db *DB) snapshotSeqs() []uint64 {
+	seqs := make([]uint64, 0, len(db.snapshots))
+	for seq := range db.snapshots {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// versionFilter picks out, from a stream of entries ordered like the output
+// of a MergingIterator, the versions that some reader may still see: the
+// newest version of each key, and for each live snapshot, the newest version
+// as of it. Everything else is shadowed for good and can be dropped.
+type versionFilter struct {
+	// sequence numbers of the live snapshots in ascending order
+	snapshots []uint64
+	// the key of the previous entry, if any, and its sequence number
+	started bool
+	key     string
+	prevSeq uint64
+}
+
+// visible reports whether item, the next entry of the stream, may still be
+// read. Every entry has to go through it, including the ones the caller
+// drops for other reasons.
+func (f *versionFilter) visible(item table.Item) bool {
+	if !f.started || item.Key != f.key {
+		// the newest version is the one read outside of any snapshot
+		f.started, f.key, f.prevSeq = true, item.Key, item.Seq
+		return true
+	}
+	// a snapshot sees the version if it was taken after it was written, but
+	// before the newer one was
+	i := sort.Search(len(f.snapshots), func(i int) bool { return f.snapshots[i] >= item.Seq })
+	visible := i < len(f.snapshots) && f.snapshots[i] < f.prevSeq
+	f.prevSeq = item.Seq
+	return visible
+}
+
+// visibleToAll reports whether every live snapshot was taken after the write
+// with the given sequence number, which makes it safe to drop a tombstone left
+// by it along with every older version.
+func (f *versionFilter) visibleToAll(seq uint64) bool {
+	return seq <= f.horizon()
+}
+
+// horizon returns the highest sequence number that's visibleToAll.
+func (f *versionFilter) horizon() uint64 {
+	if len(f.snapshots) == 0 {
+		return table.MAX_SEQUENCE
+	}
+	return f.snapshots[0]
+}
@@ -0,0 +1,244 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	table "../../03-lsm"
+)
+
+// contentsAt records what a reader should see: the live keys with their
+// values, and the keys written at some point that it shouldn't see.
+type contentsAt struct {
+	expected map[string]string
+	deleted  []string
+}
+
+func snapshotContents(expected map[string]string, keys []string) contentsAt {
+	c := contentsAt{expected: make(map[string]string, len(expected))}
+	for key, value := range expected {
+		c.expected[key] = value
+	}
+	for _, key := range keys {
+		if _, ok := expected[key]; !ok {
+			c.deleted = append(c.deleted, key)
+		}
+	}
+	return c
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{
+		MemTableSize:     1024 * 1024,
+		TargetFileSize:   4 * 1024,
+		Compaction:       &LeveledCompaction{L0CompactionTrigger: 2},
+		ManualCompaction: true,
+	}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	keys := make([]string, 500)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%04d", i)
+	}
+	expected := make(map[string]string)
+	var snapshots []*Snapshot
+	var contents []contentsAt
+	// each round overwrites and deletes some keys, and takes a snapshot
+	// before flushing every other time, so that the versions a snapshot sees
+	// are spread across the memtable and the tables
+	for round := 0; round < 6; round++ {
+		for i, key := range keys {
+			switch rand.Intn(4) {
+			case 0:
+				if err := db.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+				delete(expected, key)
+			case 1, 2:
+				value := fmt.Sprintf("%v-%d-%v", key, round, randomWord(10, 20))
+				if err := db.Put(key, value); err != nil {
+					t.Fatal(err)
+				}
+				expected[key] = value
+			default:
+				// left alone, unless the key was never written
+				if round == 0 && i%2 == 0 {
+					continue
+				}
+			}
+		}
+		snapshots = append(snapshots, db.Snapshot())
+		contents = append(contents, snapshotContents(expected, keys))
+		if round%2 == 1 {
+			flushMemTable(t, db)
+		}
+	}
+	current := snapshotContents(expected, keys)
+
+	checkAll := func() {
+		t.Helper()
+		for i, s := range snapshots {
+			if s != nil {
+				checkContents(t, s, contents[i].expected, contents[i].deleted)
+			}
+		}
+		checkContents(t, db, current.expected, current.deleted)
+	}
+	checkAll()
+
+	// compactions keep every version some snapshot can see
+	if steps := compactAll(t, db); steps == 0 {
+		t.Fatalf("Expected a compaction")
+	}
+	checkLevels(t, db)
+	checkAll()
+
+	// versions only the released snapshots could see are dropped by the next
+	// compaction, which covers every table so that nothing else is left
+	for i, s := range snapshots {
+		if i != 3 {
+			s.Release()
+			snapshots[i] = nil
+		}
+	}
+	for i := 0; i < 2; i++ {
+		// rewriting what the keys already hold changes nothing
+		for _, key := range []string{keys[0], keys[len(keys)-1]} {
+			if value, ok := expected[key]; ok {
+				err = db.Put(key, value)
+			} else {
+				err = db.Delete(key)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		flushMemTable(t, db)
+	}
+	compactAll(t, db)
+	checkLevels(t, db)
+	checkAll()
+	var entries uint64
+	for _, files := range db.current.levels {
+		for _, f := range files {
+			entries += f.t.Properties().NumEntries
+		}
+	}
+	// at most a version for the snapshot and one for the present per key
+	if entries > uint64(2*len(keys)) {
+		t.Fatalf("Expected at most %d entries once the snapshots were released, got %d", 2*len(keys), entries)
+	}
+
+	snapshots[3].Release()
+	snapshots[3].Release()
+	if _, _, err := snapshots[3].Get(keys[0]); !errors.Is(err, ErrSnapshotReleased) {
+		t.Fatalf("Expected ErrSnapshotReleased, got %v", err)
+	}
+	if _, err := snapshots[3].RangeScan("", "zzzz"); !errors.Is(err, ErrSnapshotReleased) {
+		t.Fatalf("Expected ErrSnapshotReleased, got %v", err)
+	}
+	if n := len(db.snapshots); n != 0 {
+		t.Fatalf("Expected no live snapshots, got %d", n)
+	}
+}
+
+// TestIteratorConsistency checks that an iterator reads as of when it was
+// created while the database is written to, flushed and compacted under it.
+func TestIteratorConsistency(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{
+		MemTableSize:     1024 * 1024,
+		Compaction:       &LeveledCompaction{L0CompactionTrigger: 2},
+		ManualCompaction: true,
+	}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expected := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		expected[key] = randomWord(10, 20)
+		if err := db.Put(key, expected[key]); err != nil {
+			t.Fatal(err)
+		}
+		if i == 500 {
+			flushMemTable(t, db)
+		}
+	}
+
+	iter, err := db.RangeScan("", "zzzz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+	actual := make(map[string]string)
+	for i := 0; iter.Valid(); i++ {
+		actual[iter.Key()] = iter.Value()
+		iter.Next()
+		// the keys ahead of the iterator are overwritten or deleted, and new
+		// ones are added in between
+		key := fmt.Sprintf("key%04d", i+10)
+		if i%2 == 0 {
+			err = db.Put(key, "overwritten")
+		} else {
+			err = db.Delete(key)
+		}
+		if err == nil {
+			err = db.Put(key+"a", "added")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 300 {
+			flushMemTable(t, db)
+			compactAll(t, db)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("RangeScan returned %d items that don't match the %d written before it started", len(actual), len(expected))
+	}
+}
+
+func TestVersionFilter(t *testing.T) {
+	items := []table.Item{
+		{Key: "a", Seq: 30},
+		{Key: "a", Seq: 20},
+		{Key: "a", Seq: 10},
+		{Key: "b", Seq: 25},
+		{Key: "b", Seq: 15, Kind: table.KindTombstone},
+		{Key: "b", Seq: 5},
+		{Key: "c", Seq: 12},
+	}
+	for _, test := range []struct {
+		snapshots []uint64
+		visible   []bool
+	}{
+		{nil, []bool{true, false, false, true, false, false, true}},
+		// a snapshot sees the newest version written before it
+		{[]uint64{20}, []bool{true, true, false, true, true, false, true}},
+		{[]uint64{19, 29}, []bool{true, true, true, true, true, false, true}},
+		// snapshots older than every version of a key see none of them
+		{[]uint64{1, 7, 100}, []bool{true, false, false, true, false, true, true}},
+	} {
+		f := &versionFilter{snapshots: test.snapshots}
+		for i, item := range items {
+			if visible := f.visible(item); visible != test.visible[i] {
+				t.Fatalf("Snapshots %v: expected %v to be visible: %t, got %t", test.snapshots, item, test.visible[i], visible)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"sort"
+
+	table "../../03-lsm"
+)
+
+const MAX_LEVELS = 7
+
+// tableFile is a table that's part of the database, along with the metadata
+// needed to decide which reads and compactions it takes part in.
+type tableFile struct {
+	num int
+	// file number of the newest flush whose data the table holds, which is
+	// what orders the tables in level 0
+	flushNum int
+	size     int64
+	// smallest and largest are the first and last keys in the table, or in
+	// the range of one of its range tombstones
+	smallest, largest string
+	t                 *table.Table
+	// index over the table's range tombstones
+	rangeDels *rangeDelSet
+	// number of versions holding the table, guarded by db.mu; the table is
+	// closed and deleted once it drops to 0
+	refs int
+}
+
+func (f *tableFile) overlaps(smallest, largest string) bool {
+	return f.largest >= smallest && f.smallest <= largest
+}
+
+func (f *tableFile) contains(key string) bool {
+	return f.smallest <= key && key <= f.largest
+}
+
+// version is the set of tables making up the database at some point in time.
+// A version is never modified once it's been installed; flushes and
+// compactions create a new one and swap it in.
+//
+// Level 0 holds the tables flushed from the memtable, as well as the ones
+// merged from them by size-tiered compaction, newest first. They may overlap
+// each other. Every other level holds tables with disjoint key
+// ranges, sorted by key.
+//
+// A version is referenced by the DB while it's current, and by each read
+// using it, so that its tables stay readable until the last of them is done.
+type version struct {
+	levels [MAX_LEVELS][]*tableFile
+	// guarded by db.mu
+	refs int
+}
+
+func (v *version) levelSize(level int) int64 {
+	var size int64
+	for _, f := range v.levels[level] {
+		size += f.size
+	}
+	return size
+}
+
+func (v *version) numTables() int {
+	n := 0
+	for _, files := range v.levels {
+		n += len(files)
+	}
+	return n
+}
+
+// overlapping returns the tables in level whose key range intersects
+// [smallest, largest].
+func (v *version) overlapping(level int, smallest, largest string) []*tableFile {
+	var result []*tableFile
+	for _, f := range v.levels[level] {
+		if f.overlaps(smallest, largest) {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// findTable returns the table in a level other than 0 that may hold key.
+func (v *version) findTable(level int, key string) *tableFile {
+	files := v.levels[level]
+	i := sort.Search(len(files), func(i int) bool { return files[i].largest >= key })
+	if i < len(files) && files[i].smallest <= key {
+		return files[i]
+	}
+	return nil
+}
+
+// versionEdit describes how one version differs from the one before it. It
+// also carries the bookkeeping recorded in the MANIFEST along with it, where
+// zero means unchanged.
+type versionEdit struct {
+	// numbers of the tables to remove, in any level
+	removed map[int]bool
+	added   []levelFile
+
+	// every log numbered below logNum has been flushed
+	logNum       int
+	nextFileNum  int
+	lastSequence uint64
+}
+
+type levelFile struct {
+	level int
+	f     *tableFile
+}
+
+// apply returns a new version made of v with the edit applied.
+func (v *version) apply(edit *versionEdit) *version {
+	next := &version{}
+	for level, files := range v.levels {
+		for _, f := range files {
+			if !edit.removed[f.num] {
+				next.levels[level] = append(next.levels[level], f)
+			}
+		}
+	}
+	for _, added := range edit.added {
+		next.levels[added.level] = append(next.levels[added.level], added.f)
+	}
+
+	sort.Slice(next.levels[0], func(i, j int) bool {
+		return next.levels[0][i].flushNum > next.levels[0][j].flushNum
+	})
+	for level := 1; level < MAX_LEVELS; level++ {
+		files := next.levels[level]
+		sort.Slice(files, func(i, j int) bool { return files[i].smallest < files[j].smallest })
+	}
+	return next
+}
@@ -0,0 +1,233 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	table "../../03-lsm"
+)
+
+/*
+write-ahead log format:
+record record ... record
+
+record format:
+checksum, payload_size, size_checksum, payload
+
+checksum is the CRC32C of the payload and size_checksum that of payload_size,
+so that a damaged payload_size can be told apart from a record that was cut
+short. All three are 4 byte big endian integers.
+
+payload format:
+sequence, count, entry entry ... entry
+
+entry format:
+kind, key_size, key, value_size, value
+
+Each payload holds a batch of writes (see WriteBatch), which are numbered
+consecutively from sequence. sequence, count, key_size and value_size are
+uvarints, and each kind is 1 byte. The key and value of a range tombstone
+(kindRangeDelete) are the start and end of its range.
+*/
+
+const WAL_HEADER_SIZE = 12
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// walWriter appends records to a write-ahead log file.
+type walWriter struct {
+	f    *os.File
+	buf  []byte
+	sync bool
+}
+
+func createWAL(path string, sync bool) (*walWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &walWriter{f: f, sync: sync}, nil
+}
+
+// append writes a single record to the log. The record is handed to the
+// operating system before returning, and also synced to disk if the writer
+// was created with sync enabled.
+func (w *walWriter) append(payload []byte) error {
+	w.buf = w.buf[:0]
+	w.buf = binary.BigEndian.AppendUint32(w.buf, crc32.Checksum(payload, crcTable))
+	w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(len(payload)))
+	w.buf = binary.BigEndian.AppendUint32(w.buf, crc32.Checksum(w.buf[4:8], crcTable))
+	w.buf = append(w.buf, payload...)
+	if _, err := w.f.Write(w.buf); err != nil {
+		return err
+	}
+	if w.sync {
+		return w.f.Sync()
+	}
+	return nil
+}
+
+func (w *walWriter) close() error {
+	return w.f.Close()
+}
+
+// replayWAL calls fn with the payload of every record in the log at path, in
+// the order they were written. A torn final record, as left behind by a
+// crash in the middle of an append, ends the replay without an error: one
+// whose header or payload runs past the end of the file, or whose payload
+// doesn't match its checksum but ends right at the end of the file. Any other
+// damaged record is reported as corruption. complete reports whether the
+// replay reached the end of the log rather than stopping at a torn record.
+func replayWAL(path string, fn func(payload []byte) error) (complete bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	size := info.Size()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, WAL_HEADER_SIZE)
+	offset := int64(0)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return true, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return false, nil
+			}
+			return false, err
+		}
+		checksum := binary.BigEndian.Uint32(header[:4])
+		if crc32.Checksum(header[4:8], crcTable) != binary.BigEndian.Uint32(header[8:]) {
+			return false, fmt.Errorf("%v: damaged header in log record at offset %d", path, offset)
+		}
+		payloadSize := int64(binary.BigEndian.Uint32(header[4:8]))
+		end := offset + WAL_HEADER_SIZE + payloadSize
+		if end > size {
+			// the payload was never completely written
+			return false, nil
+		}
+
+		payload := make([]byte, payloadSize)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return false, err
+		}
+		if crc32.Checksum(payload, crcTable) != checksum {
+			if end == size {
+				return false, nil
+			}
+			return false, fmt.Errorf("%v: checksum mismatch in log record at offset %d", path, offset)
+		}
+		if err := fn(payload); err != nil {
+			return false, err
+		}
+		offset = end
+	}
+}
+
+// encodeLogRecord encodes a batch of writes numbered from seq.
+func encodeLogRecord(seq uint64, items []table.Item) []byte {
+	size := 2 * binary.MaxVarintLen64
+	for _, item := range items {
+		size += 1 + 2*binary.MaxVarintLen64 + len(item.Key) + len(item.Value)
+	}
+	payload := make([]byte, 0, size)
+	payload = binary.AppendUvarint(payload, seq)
+	payload = binary.AppendUvarint(payload, uint64(len(items)))
+	for _, item := range items {
+		payload = append(payload, byte(item.Kind))
+		payload = binary.AppendUvarint(payload, uint64(len(item.Key)))
+		payload = append(payload, item.Key...)
+		payload = binary.AppendUvarint(payload, uint64(len(item.Value)))
+		payload = append(payload, item.Value...)
+	}
+	return payload
+}
+
+var errMalformedLogRecord = errors.New("malformed log record")
+
+// logDecoder reads the fields of a log record, remembering the first error it
+// runs into.
+type logDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *logDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errMalformedLogRecord
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return x
+}
+
+func (d *logDecoder) kind() table.Kind {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.buf) == 0 || table.Kind(d.buf[0]) > kindRangeDelete {
+		d.err = errMalformedLogRecord
+		return 0
+	}
+	kind := table.Kind(d.buf[0])
+	d.buf = d.buf[1:]
+	return kind
+}
+
+func (d *logDecoder) string() string {
+	size := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(len(d.buf)) < size {
+		d.err = errMalformedLogRecord
+		return ""
+	}
+	s := string(d.buf[:size])
+	d.buf = d.buf[size:]
+	return s
+}
+
+// decodeLogRecord returns the writes in a record, with their sequence
+// numbers.
+func decodeLogRecord(payload []byte) ([]table.Item, error) {
+	d := &logDecoder{buf: payload}
+	seq := d.uvarint()
+	count := d.uvarint()
+	// every entry takes at least 3 bytes, which keeps a damaged count from
+	// allocating more than the payload could hold
+	if d.err != nil || count > uint64(len(d.buf)/3) {
+		return nil, errMalformedLogRecord
+	}
+	items := make([]table.Item, count)
+	for i := range items {
+		items[i].Seq = seq + uint64(i)
+		items[i].Kind = d.kind()
+		items[i].Key = d.string()
+		items[i].Value = d.string()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(d.buf) > 0 {
+		return nil, errMalformedLogRecord
+	}
+	return items, nil
+}
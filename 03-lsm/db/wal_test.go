@@ -0,0 +1,264 @@
+package db
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	table "../../03-lsm"
+)
+
+type logEntry struct {
+	seq        uint64
+	kind       table.Kind
+	key, value string
+}
+
+// readLog returns the entries in the log at path, and whether it ended in a
+// torn record.
+func readLog(t *testing.T, path string) ([]logEntry, bool) {
+	t.Helper()
+	var entries []logEntry
+	complete, err := replayWAL(path, func(payload []byte) error {
+		items, err := decodeLogRecord(payload)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			entries = append(entries, logEntry{item.Seq, item.Kind, item.Key, item.Value})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error replaying log %v: %v", path, err)
+	}
+	return entries, !complete
+}
+
+// Simulates a crash at every possible point while writing the log: replaying
+// a log truncated at any byte offset must yield exactly the records that
+// were completely written before that offset.
+func TestWALTruncation(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "000001.log")
+
+	w, err := createWAL(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []logEntry
+	// ends[i] is the size of the log once entries[i] has been written
+	var ends []int
+	size := 0
+	for i := 0; i < 20; i++ {
+		entry := logEntry{uint64(i + 1), table.KindValue, randomWord(1, 10), randomWord(0, 20)}
+		if i%5 == 0 {
+			entry = logEntry{uint64(i + 1), table.KindTombstone, randomWord(1, 10), ""}
+		}
+		payload := encodeLogRecord(entry.seq, []table.Item{{Key: entry.key, Value: entry.value, Kind: entry.kind}})
+		if err := w.append(payload); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+		size += WAL_HEADER_SIZE + len(payload)
+		ends = append(ends, size)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != size {
+		t.Fatalf("Expected log to be %d bytes, got %d", size, len(data))
+	}
+
+	truncated := filepath.Join(dir, "truncated.log")
+	complete := 0
+	for offset := 0; offset <= len(data); offset++ {
+		for complete < len(ends) && ends[complete] <= offset {
+			complete++
+		}
+		if err := ioutil.WriteFile(truncated, data[:offset], 0600); err != nil {
+			t.Fatal(err)
+		}
+		actual, torn := readLog(t, truncated)
+		if len(actual) != complete {
+			t.Fatalf("Log truncated at offset %d: expected %d records, got %d", offset, complete, len(actual))
+		}
+		// anything past the end of the last complete record is a torn one
+		written := 0
+		if complete > 0 {
+			written = ends[complete-1]
+		}
+		if expected := offset > written; torn != expected {
+			t.Fatalf("Log truncated at offset %d: expected torn to be %t", offset, expected)
+		}
+		for i := range actual {
+			if actual[i] != entries[i] {
+				t.Fatalf("Log truncated at offset %d: expected record %d to be %v, got %v", offset, i, entries[i], actual[i])
+			}
+		}
+	}
+}
+
+func TestWALCorruption(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "000001.log")
+
+	w, err := createWAL(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := w.append(encodeLogRecord(uint64(i+1), []table.Item{{Key: "key", Value: "value"}})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// damage the payload of the first record
+	data[WAL_HEADER_SIZE] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replayWAL(path, func([]byte) error { return nil }); err == nil {
+		t.Fatalf("Expected an error replaying a log with a damaged record")
+	}
+}
+
+// A damaged header must not be mistaken for a record cut short by a crash,
+// which would silently drop every record after it.
+func TestWALHeaderCorruption(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "000001.log")
+
+	w, err := createWAL(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// starts[i] is the offset of the i'th record
+	var starts []int
+	size := 0
+	for i := 0; i < 100; i++ {
+		payload := encodeLogRecord(uint64(i+1), []table.Item{{Key: randomWord(1, 10), Value: randomWord(0, 20)}})
+		if err := w.append(payload); err != nil {
+			t.Fatal(err)
+		}
+		starts = append(starts, size)
+		size += WAL_HEADER_SIZE + len(payload)
+	}
+	w.close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged := filepath.Join(dir, "damaged.log")
+	for _, record := range []int{0, 50, 98} {
+		for i := 0; i < WAL_HEADER_SIZE; i++ {
+			offset := starts[record] + i
+			for _, flip := range []byte{0x01, 0x80, 0xff} {
+				data[offset] ^= flip
+				if err := ioutil.WriteFile(damaged, data, 0600); err != nil {
+					t.Fatal(err)
+				}
+				data[offset] ^= flip
+				if _, err := replayWAL(damaged, func([]byte) error { return nil }); err == nil {
+					t.Fatalf("Expected an error replaying a log with byte %d of record %d's header flipped by %#x", i, record, flip)
+				}
+			}
+		}
+	}
+}
+
+func TestLogRecordEncoding(t *testing.T) {
+	items := []table.Item{
+		{Key: "a", Value: "1", Seq: 1 << 40},
+		{Key: "", Value: "", Seq: 1<<40 + 1},
+		{Key: "a", Kind: table.KindTombstone, Seq: 1<<40 + 2},
+		{Key: randomWord(100, 200), Value: randomWord(100, 200), Seq: 1<<40 + 3},
+		{Key: "b", Value: "c", Kind: kindRangeDelete, Seq: 1<<40 + 4},
+	}
+	payload := encodeLogRecord(1<<40, items)
+	actual, err := decodeLogRecord(payload)
+	if err != nil || !reflect.DeepEqual(items, actual) {
+		t.Fatalf("Expected %v, got (%v, %v)", items, actual, err)
+	}
+	for i := 0; i < len(payload); i++ {
+		if _, err := decodeLogRecord(payload[:i]); err == nil {
+			t.Fatalf("Expected decoding a record truncated to %d bytes to fail", i)
+		}
+	}
+	if _, err := decodeLogRecord(append(payload, 0)); err == nil {
+		t.Fatalf("Expected decoding a record with trailing bytes to fail")
+	}
+}
+
+// Writes that were logged but never flushed must be visible after reopening
+// a database that wasn't closed.
+func TestDBRecovery(t *testing.T) {
+	dir := tempDir(t)
+	opts := &Options{MemTableSize: 64 * 1024}
+
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string]string)
+	var deleted []string
+	for i := 0; i < 3000; i++ {
+		key := randomWord(3, 6)
+		value := randomWord(10, 20)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = value
+	}
+	for key := range expected {
+		if len(deleted) == 100 {
+			break
+		}
+		if err := db.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		deleted = append(deleted, key)
+	}
+	for _, key := range deleted {
+		delete(expected, key)
+	}
+	if db.mem.len() == 0 {
+		t.Fatalf("Expected some writes to be only in the memtable")
+	}
+
+	// simulate a crash by abandoning db without closing it
+	db.log.close()
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			db.log.close()
+		}
+		db, err = Open(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkContents(t, db, expected, deleted)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	logNums, err := listFiles(dir, LOG_FILE_EXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logNums) != 0 {
+		t.Fatalf("Expected no logs to remain after closing, found %v", logNums)
+	}
+}
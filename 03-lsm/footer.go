@@ -0,0 +1,301 @@
+package table
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// ErrNotTable is returned by LoadTable for files that don't end with a table
+// footer, which is most likely because they aren't tables at all.
+var ErrNotTable = errors.New("not a table file")
+
+// ErrUnsupportedVersion is returned by LoadTable for tables written in a
+// format version this package can't read, usually by a newer version of it.
+var ErrUnsupportedVersion = errors.New("unsupported table format version")
+
+const (
+	// "lsm_tabl"
+	TABLE_MAGIC = 0x6c736d5f7461626c
+	// the format version written by Build
+	FORMAT_VERSION = 6
+
+	// room for the uvarints of the handles and index_entry_#, padded out to
+	// their largest size, along with 2 more that are left as padding
+	FOOTER_HANDLES_SIZE = 7 * binary.MaxVarintLen64
+	// handles, version, checksum and magic
+	FOOTER_SIZE = FOOTER_HANDLES_SIZE + 4 + CHECKSUM_SIZE + 8
+	// filter_offset, filter_size, properties_offset, properties_size,
+	// index_offset, index_entry_# and checksum
+	FOOTER_V1_SIZE = 28
+
+	// names of the blocks listed in the meta-index
+	META_FILTER          = "filter.bloom"
+	META_PROPERTIES      = "properties"
+	META_RANGE_DELETIONS = "rangedel"
+)
+
+/*
+footer format:
+metaindex_handle index_handle index_entry_# padding version checksum magic
+
+Each handle is an offset and a size, and both they and index_entry_# are
+uvarints, padded with zeros to FOOTER_HANDLES_SIZE bytes. version is 4 bytes,
+the checksum covers everything before it, and magic is TABLE_MAGIC in 8 bytes.
+Versions 2 to 5 were only ever written by unreleased versions of this package,
+and can't be read. Since the version and the magic number sit at the same
+place in the footers of every version from 2 on, a reader can always tell a
+table it's too old to read from a file that isn't a table at all.
+
+metaindex_block format: a data block whose keys are the names of the other
+blocks (META_FILTER, META_PROPERTIES and META_RANGE_DELETIONS), sorted, and
+whose values are their handles. Names the reader doesn't know are skipped, so
+blocks can be added without changing the footer, as long as a reader that
+skips them still reads the table right; the range deletion block isn't one of
+those, which is why it came with a new version. The Bloom filter is left out
+when the table has none, and so is the range deletion block.
+
+Tables written before the format was versioned (version 1) have no magic
+number, and use 4 bytes for every offset and size. Their footer is:
+filter_offset filter_size properties_offset properties_size index_offset index_entry_# checksum
+
+and the size of the index follows from index_offset and the start of the
+footer. They always have a filter block, which is empty when the table has no
+Bloom filter, but never a partitioned index, sequence numbers or range
+tombstones.
+*/
+
+// blockHandle locates a block in the file, not counting its trailer.
+type blockHandle struct {
+	offset, size uint64
+}
+
+// end returns the offset just past the block's trailer.
+func (h blockHandle) end() uint64 {
+	return h.offset + h.size + BLOCK_TRAILER_SIZE
+}
+
+// within reports whether the block, trailer included, ends at or before
+// limit.
+func (h blockHandle) within(limit uint64) bool {
+	// written so that none of it can overflow
+	return h.offset <= limit && h.size <= limit-h.offset && BLOCK_TRAILER_SIZE <= limit-h.offset-h.size
+}
+
+func (h blockHandle) append(buf []byte) []byte {
+	buf = binary.AppendUvarint(buf, h.offset)
+	return binary.AppendUvarint(buf, h.size)
+}
+
+// decodeBlockHandle decodes the handle at the start of buf and returns it
+// along with its size, which is 0 if buf doesn't start with a whole handle.
+func decodeBlockHandle(buf []byte) (blockHandle, int) {
+	offset, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return blockHandle{}, 0
+	}
+	size, m := binary.Uvarint(buf[n:])
+	if m <= 0 {
+		return blockHandle{}, 0
+	}
+	return blockHandle{offset, size}, n + m
+}
+
+type footer struct {
+	version      int
+	metaIndex    blockHandle
+	index        blockHandle
+	indexEntries uint64
+	// the blocks listed in the meta-index. Version 1 footers fill it in
+	// themselves.
+	meta map[string]blockHandle
+}
+
+func (ft *footer) encode() []byte {
+	buf := make([]byte, 0, FOOTER_SIZE)
+	buf = ft.metaIndex.append(buf)
+	buf = ft.index.append(buf)
+	buf = binary.AppendUvarint(buf, ft.indexEntries)
+	buf = buf[:FOOTER_HANDLES_SIZE]
+	buf = binary.BigEndian.AppendUint32(buf, FORMAT_VERSION)
+	buf = appendChecksum(buf)
+	return binary.BigEndian.AppendUint64(buf, TABLE_MAGIC)
+}
+
+// readFooter reads the footer at the end of the file, of whichever format
+// version it is, and returns it along with the offset it starts at.
+func (t *Table) readFooter(f *os.File, fileSize int64) (*footer, int64, error) {
+	if fileSize >= FOOTER_SIZE {
+		buf := make([]byte, FOOTER_SIZE)
+		if _, err := f.ReadAt(buf, fileSize-FOOTER_SIZE); err != nil {
+			return nil, 0, err
+		}
+		if binary.BigEndian.Uint64(buf[FOOTER_SIZE-8:]) == TABLE_MAGIC {
+			ft, err := t.decodeFooter(buf, fileSize-FOOTER_SIZE)
+			return ft, fileSize - FOOTER_SIZE, err
+		}
+	}
+	ft, err := t.readFooterV1(f, fileSize)
+	return ft, fileSize - FOOTER_V1_SIZE, err
+}
+
+func (t *Table) decodeFooter(buf []byte, offset int64) (*footer, error) {
+	if !checksumMatches(buf[:FOOTER_SIZE-8]) {
+		return nil, t.corruption(offset, "footer checksum mismatch")
+	}
+	ft := &footer{version: int(binary.BigEndian.Uint32(buf[FOOTER_HANDLES_SIZE:]))}
+	if ft.version != FORMAT_VERSION {
+		return nil, fmt.Errorf("%v: %w %d (this package reads versions 1 and %d)", t.FilePath, ErrUnsupportedVersion, ft.version, FORMAT_VERSION)
+	}
+	buf = buf[:FOOTER_HANDLES_SIZE]
+	for _, h := range []*blockHandle{&ft.metaIndex, &ft.index} {
+		var n int
+		*h, n = decodeBlockHandle(buf)
+		if n == 0 {
+			return nil, t.corruption(offset, "malformed footer")
+		}
+		buf = buf[n:]
+	}
+	var n int
+	ft.indexEntries, n = binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, t.corruption(offset, "malformed footer")
+	}
+	return ft, nil
+}
+
+// readFooterV1 reads the footer of a table that has no magic number, which
+// is either a version 1 table or not a table at all. Only the checksum can
+// tell them apart.
+func (t *Table) readFooterV1(f *os.File, fileSize int64) (*footer, error) {
+	if fileSize < FOOTER_V1_SIZE {
+		return nil, fmt.Errorf("%v: %w (%d bytes is too short to hold a footer)", t.FilePath, ErrNotTable, fileSize)
+	}
+	footerOffset := fileSize - FOOTER_V1_SIZE
+	buf := make([]byte, FOOTER_V1_SIZE)
+	if _, err := f.ReadAt(buf, footerOffset); err != nil {
+		return nil, err
+	}
+	if !checksumMatches(buf) {
+		return nil, fmt.Errorf("%v: %w (no magic number at the end of the file)", t.FilePath, ErrNotTable)
+	}
+	ft := &footer{
+		version: 1,
+		meta: map[string]blockHandle{
+			META_FILTER:     {uint64(binary.BigEndian.Uint32(buf[0:4])), uint64(binary.BigEndian.Uint32(buf[4:8]))},
+			META_PROPERTIES: {uint64(binary.BigEndian.Uint32(buf[8:12])), uint64(binary.BigEndian.Uint32(buf[12:16]))},
+		},
+		index:        blockHandle{offset: uint64(binary.BigEndian.Uint32(buf[16:20]))},
+		indexEntries: uint64(binary.BigEndian.Uint32(buf[20:24])),
+	}
+	// the index runs up to the footer
+	if ft.index.offset+BLOCK_TRAILER_SIZE > uint64(footerOffset) {
+		return nil, t.corruption(footerOffset, "footer points outside the file")
+	}
+	ft.index.size = uint64(footerOffset) - ft.index.offset - BLOCK_TRAILER_SIZE
+	return ft, nil
+}
+
+func encodeMetaIndex(meta map[string]blockHandle) []byte {
+	names := make([]string, 0, len(meta))
+	for name := range meta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	block := newBlockBuilder(DEFAULT_BLOCK_RESTART_INTERVAL)
+	for _, name := range names {
+		block.add(Item{Key: name, Value: string(meta[name].append(nil))})
+	}
+	return block.finish()
+}
+
+func (t *Table) decodeMetaIndex(offset int64, data []byte) (map[string]blockHandle, error) {
+	block, err := t.newBlockIterator(offset, data)
+	if err != nil {
+		return nil, err
+	}
+	meta := map[string]blockHandle{}
+	for {
+		item, ok, err := block.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return meta, nil
+		}
+		h, n := decodeBlockHandle([]byte(item.Value))
+		if n == 0 || n != len(item.Value) {
+			return nil, t.corruption(offset, "malformed meta-index entry "+item.Key)
+		}
+		meta[item.Key] = h
+	}
+}
+
+/*
+index_entry format:
+key_size, key, offset, block_size, item_count
+
+all of them but the key are uvarints. In version 1 they are 4 bytes each.
+*/
+
+func encodeIndexEntry(buf []byte, entry *indexEntry) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(entry.key)))
+	buf = append(buf, entry.key...)
+	buf = binary.AppendUvarint(buf, entry.offset)
+	buf = binary.AppendUvarint(buf, entry.blockSize)
+	return binary.AppendUvarint(buf, entry.itemCount)
+}
+
+// decodeIndexEntry decodes the index entry at the start of buf and returns
+// it along with its size, which is 0 if buf doesn't start with a whole entry.
+func decodeIndexEntry(buf []byte, version int) (*indexEntry, int) {
+	if version == 1 {
+		return decodeIndexEntryV1(buf)
+	}
+	pos := 0
+	uvarint := func() (uint64, bool) {
+		x, n := binary.Uvarint(buf[pos:])
+		if n <= 0 {
+			return 0, false
+		}
+		pos += n
+		return x, true
+	}
+	keySize, ok := uvarint()
+	if !ok || keySize > uint64(len(buf)-pos) {
+		return nil, 0
+	}
+	entry := &indexEntry{key: string(buf[pos : pos+int(keySize)])}
+	pos += int(keySize)
+	var ok1, ok2, ok3 bool
+	entry.offset, ok1 = uvarint()
+	entry.blockSize, ok2 = uvarint()
+	entry.itemCount, ok3 = uvarint()
+	if !ok1 || !ok2 || !ok3 {
+		return nil, 0
+	}
+	return entry, pos
+}
+
+func decodeIndexEntryV1(buf []byte) (*indexEntry, int) {
+	if len(buf) < KEY_LENGTH_SIZE {
+		return nil, 0
+	}
+	keySize := binary.BigEndian.Uint32(buf)
+	// the key is followed by offset, block_size and item_count
+	if uint64(len(buf)) < KEY_LENGTH_SIZE+uint64(keySize)+12 {
+		return nil, 0
+	}
+	pos := KEY_LENGTH_SIZE + int(keySize)
+	key := string(buf[KEY_LENGTH_SIZE:pos])
+
+	return &indexEntry{
+		key:       key,
+		offset:    uint64(binary.BigEndian.Uint32(buf[pos:])),
+		blockSize: uint64(binary.BigEndian.Uint32(buf[pos+4:])),
+		itemCount: uint64(binary.BigEndian.Uint32(buf[pos+8:])),
+	}, pos + 12
+}
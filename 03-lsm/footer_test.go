@@ -0,0 +1,138 @@
+package table
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testdata/v1.table was written by Build before the format was versioned. It
+// holds key00000 to key00999, with value00000 to value00999, except that every
+// seventh key is a tombstone.
+func TestLoadTableV1(t *testing.T) {
+	const path = "testdata/v1.table"
+	table, err := LoadTable(path)
+	if err != nil {
+		t.Fatalf("Error loading Table: %v", err)
+	}
+	defer table.Close()
+	if table.formatVersion != 1 {
+		t.Fatalf("%v: expected format version 1, got %d", path, table.formatVersion)
+	}
+
+	var expected []Item
+	for i := 0; i < 1000; i++ {
+		item := Item{Key: fmt.Sprintf("key%05d", i), Value: fmt.Sprintf("value%05d", i)}
+		if i%7 == 0 {
+			item = Item{Key: item.Key, Kind: KindTombstone}
+		}
+		expected = append(expected, item)
+
+		actual, ok, err := table.Lookup(item.Key)
+		if err != nil || !ok || actual != item {
+			t.Fatalf("%v: Lookup(%q): expected %v, got (%v, %t, %v)", path, item.Key, item, actual, ok, err)
+		}
+	}
+	// the key range is worked out for tables that didn't record it
+	if p := table.Properties(); p.SmallestKey != "key00000" || p.LargestKey != "key00999" {
+		t.Fatalf("%v: unexpected key range [%q, %q]", path, p.SmallestKey, p.LargestKey)
+	}
+	if _, ok, err := table.Lookup("key10000"); err != nil || ok {
+		t.Fatalf("%v: expected key %q not to exist (err %v)", path, "key10000", err)
+	}
+
+	iter, err := table.RangeScan("", "zzzzzzzzzzzzzzzzzzzz")
+	if err != nil {
+		t.Fatalf("Error creating RangeScan: %v", err)
+	}
+	var actualScan []Item
+	for ; iter.Valid(); iter.Next() {
+		actualScan = append(actualScan, iter.Item())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("Error during RangeScan: %v", err)
+	}
+	if !reflect.DeepEqual(expected, actualScan) {
+		t.Fatalf("%v: unexpected RangeScan result", path)
+	}
+}
+
+func TestLoadTableRejectsOtherFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	random := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(random)
+	// files that end like a table, but were written by a later format
+	// version, or by one of those that were never released
+	withVersion := func(version uint32) []byte {
+		buf := make([]byte, 1000)
+		footer := buf[len(buf)-FOOTER_SIZE:]
+		binary.BigEndian.PutUint32(footer[FOOTER_HANDLES_SIZE:], version)
+		appendChecksum(footer[:FOOTER_HANDLES_SIZE+4])
+		binary.BigEndian.PutUint64(footer[FOOTER_SIZE-8:], TABLE_MAGIC)
+		return buf
+	}
+
+	for _, test := range []struct {
+		name     string
+		contents []byte
+		expected error
+	}{
+		{"empty", nil, ErrNotTable},
+		{"short", []byte("lsm"), ErrNotTable},
+		{"text", []byte("this is not a table, although it is long enough to hold a footer\n"), ErrNotTable},
+		{"random", random, ErrNotTable},
+		{"newer", withVersion(FORMAT_VERSION + 1), ErrUnsupportedVersion},
+		{"unreleased", withVersion(5), ErrUnsupportedVersion},
+	} {
+		path := filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(path, test.contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadTable(path); !errors.Is(err, test.expected) {
+			t.Fatalf("%v: expected %v, got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+// Offsets past 4 GiB can't be tested with real files in reasonable time, so
+// they're checked on the encodings alone.
+func TestLargeOffsets(t *testing.T) {
+	entry := indexEntry{key: "key", offset: 5 << 32, blockSize: 3 << 32, itemCount: 1 << 40}
+	buf := encodeIndexEntry(nil, &entry)
+	decoded, n := decodeIndexEntry(buf, FORMAT_VERSION)
+	if n != len(buf) || !reflect.DeepEqual(&entry, decoded) {
+		t.Fatalf("Index entry %+v decoded as %+v (%d of %d bytes)", entry, decoded, n, len(buf))
+	}
+	if _, n := decodeIndexEntry(buf[:len(buf)-1], FORMAT_VERSION); n != 0 {
+		t.Fatalf("Expected a truncated index entry not to decode")
+	}
+
+	ft := footer{
+		version:      FORMAT_VERSION,
+		metaIndex:    blockHandle{1 << 40, 1 << 20},
+		index:        blockHandle{1<<64 - 1, 1<<64 - 1},
+		indexEntries: 1<<64 - 1,
+	}
+	buf = ft.encode()
+	if len(buf) != FOOTER_SIZE {
+		t.Fatalf("Expected a %d byte footer, got %d bytes", FOOTER_SIZE, len(buf))
+	}
+	decodedFooter, err := (&Table{}).decodeFooter(buf, 0)
+	if err != nil || !reflect.DeepEqual(&ft, decodedFooter) {
+		t.Fatalf("Footer %+v decoded as %+v (err %v)", ft, decodedFooter, err)
+	}
+	if (blockHandle{1<<64 - 1, 1<<64 - 1}).within(1<<64 - 1) {
+		t.Fatalf("Expected a handle whose end overflows not to be within the file")
+	}
+}
@@ -0,0 +1,190 @@
+package table
+
+import (
+	"os"
+	"sort"
+)
+
+const (
+	// Number of bytes of decoded index partitions a table keeps cached when
+	// it isn't given a BlockCache.
+	PARTITION_CACHE_SIZE = 1024 * 1024
+	// what a decoded index entry takes up besides its key: the key's string
+	// header, offset, block_size and item_count
+	INDEX_ENTRY_OVERHEAD = 16 + 3*8
+)
+
+/*
+A table's index has an entry for each data block, keyed by the block's last
+key. It's normally held in memory in full, as a slice sorted by key that
+lookups binary search.
+
+A partitioned index (see Options.IndexPartitionSize) is instead split into
+index partitions, which are written between the data blocks and the filter:
+
+index_partition format:
+index_entry index_entry ... index_entry
+
+and the index that the footer points to is a top-level index with an entry
+for each partition, keyed by the partition's last key, whose item_count is
+the number of entries in the partition. Only the top-level index is held in
+memory; partitions are read as lookups and scans reach them, and kept in the
+cache decoded, so that a lookup can binary search them right away. The PROPERTY_INDEX_PARTITIONS property records that the index is
+partitioned, which a version 1 table's never is.
+*/
+
+// decodeIndexEntries decodes the index entries that fill data, checking that
+// each of them points to a block that ends before limit.
+func (t *Table) decodeIndexEntries(offset int64, data []byte, limit uint64) ([]indexEntry, error) {
+	var entries []indexEntry
+	for pos := 0; pos < len(data); {
+		entry, n := decodeIndexEntry(data[pos:], t.formatVersion)
+		if n == 0 {
+			return nil, t.corruption(offset+int64(pos), "malformed index entry")
+		}
+		if !(blockHandle{entry.offset, entry.blockSize}).within(limit) {
+			return nil, t.corruption(offset+int64(pos), "index entry points outside the data blocks")
+		}
+		pos += n
+		entries = append(entries, *entry)
+	}
+	return entries, nil
+}
+
+// partitioned reports whether t.index is a top-level index.
+func (t *Table) partitioned() bool {
+	return t.properties.IndexPartitions > 0
+}
+
+// searchIndex returns the position of the first entry of t.index whose key
+// is >= key, or len(t.index) if there's none.
+func (t *Table) searchIndex(key string) int {
+	return sort.Search(len(t.index), func(i int) bool { return t.index[i].key >= key })
+}
+
+// indexIterator walks the entries of a table's index in key order, reading
+// the partitions of a partitioned index as it reaches them.
+type indexIterator struct {
+	t *Table
+	// the table's file, if the caller is holding it open; see readBlock
+	file *os.File
+	// position in t.index
+	i int
+	// the entries of the partition i stands for, and the position of the
+	// current one, when the index is partitioned
+	partition []indexEntry
+	pos       int
+}
+
+// seekIndex returns an iterator positioned at the first index entry whose
+// key is >= key, which is the entry of the only block that can hold key.
+func (t *Table) seekIndex(f *os.File, key string) (indexIterator, error) {
+	iter := indexIterator{t: t, file: f, i: t.searchIndex(key)}
+	if err := iter.load(); err != nil {
+		return indexIterator{}, err
+	}
+	// a partition ends with its key in the top-level index, which is >= key,
+	// so the search can't run past its end
+	if iter.partition != nil {
+		iter.pos = sort.Search(len(iter.partition), func(i int) bool { return iter.partition[i].key >= key })
+	}
+	return iter, nil
+}
+
+// seekIndexToLast returns an iterator positioned at the last index entry.
+func (t *Table) seekIndexToLast(f *os.File) (indexIterator, error) {
+	iter := indexIterator{t: t, file: f, i: len(t.index) - 1}
+	if err := iter.load(); err != nil {
+		return indexIterator{}, err
+	}
+	if iter.partition != nil {
+		iter.pos = len(iter.partition) - 1
+	}
+	return iter, nil
+}
+
+func (iter *indexIterator) valid() bool {
+	return iter.i >= 0 && iter.i < len(iter.t.index)
+}
+
+// current returns the entry the iterator is at. Assumes valid() == true.
+func (iter *indexIterator) current() *indexEntry {
+	if iter.partition != nil {
+		return &iter.partition[iter.pos]
+	}
+	return &iter.t.index[iter.i]
+}
+
+func (iter *indexIterator) next() error {
+	if iter.partition != nil && iter.pos+1 < len(iter.partition) {
+		iter.pos++
+		return nil
+	}
+	iter.i++
+	iter.pos = 0
+	return iter.load()
+}
+
+func (iter *indexIterator) prev() error {
+	if iter.partition != nil && iter.pos > 0 {
+		iter.pos--
+		return nil
+	}
+	iter.i--
+	if err := iter.load(); err != nil {
+		return err
+	}
+	if iter.partition != nil {
+		iter.pos = len(iter.partition) - 1
+	}
+	return nil
+}
+
+// load reads the partition that the entry at i stands for, if the index is
+// partitioned.
+func (iter *indexIterator) load() error {
+	iter.partition = nil
+	if !iter.t.partitioned() || !iter.valid() {
+		return nil
+	}
+	partition, err := iter.t.readPartition(iter.file, &iter.t.index[iter.i])
+	if err != nil {
+		return err
+	}
+	iter.partition = partition
+	return nil
+}
+
+// readPartition returns the entries of the index partition that top stands
+// for, from t.partitionCache if they're there. f is the table's file if the
+// caller is already holding it open, and nil otherwise.
+func (t *Table) readPartition(f *os.File, top *indexEntry) ([]indexEntry, error) {
+	key := cacheKey{t.id, int64(top.offset)}
+	if partition, ok := t.partitionCache.get(key); ok {
+		return partition.([]indexEntry), nil
+	}
+	if f == nil {
+		var err error
+		if f, err = t.handle.acquire(); err != nil {
+			return nil, err
+		}
+		defer t.handle.release()
+	}
+	data, err := t.readBlockFrom(f, int64(top.offset), int(top.blockSize))
+	if err != nil {
+		return nil, err
+	}
+	partition, err := t.decodeIndexEntries(int64(top.offset), data, t.dataEnd)
+	if err != nil {
+		return nil, err
+	}
+	if len(partition) == 0 || uint64(len(partition)) != top.itemCount || partition[len(partition)-1].key != top.key {
+		return nil, t.corruption(int64(top.offset), "index partition doesn't match its top-level entry")
+	}
+	size := int64(len(partition)) * INDEX_ENTRY_OVERHEAD
+	for i := range partition {
+		size += int64(len(partition[i].key))
+	}
+	t.partitionCache.add(key, partition, size)
+	return partition, nil
+}
@@ -0,0 +1,137 @@
+package table
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestPartitionedIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpfile := filepath.Join(dir, "tmpfile")
+	sortedItems := generateSortedItems(20000)
+	for i := range sortedItems {
+		if i%9 == 0 {
+			sortedItems[i] = Item{Key: sortedItems[i].Key, Kind: KindTombstone}
+		}
+	}
+	if err := BuildWithOptions(tmpfile, sortedItems, &Options{IndexPartitionSize: 512}); err != nil {
+		t.Fatalf("Error building Table: %v", err)
+	}
+	cache := NewCache(1 << 20)
+	table, err := LoadTableWithOptions(tmpfile, &Options{BlockCache: cache})
+	if err != nil {
+		t.Fatalf("Error loading Table: %v", err)
+	}
+	defer table.Close()
+
+	// only the top-level index is held in memory
+	props := table.Properties()
+	resident := len(table.index)
+	if props.IndexPartitions < 2 || uint64(resident) != props.IndexPartitions || props.IndexPartitions*10 > props.DataBlocks {
+		t.Fatalf("Expected a few partitions for %d blocks, got %d with %d entries in memory", props.DataBlocks, props.IndexPartitions, resident)
+	}
+
+	for _, item := range sortedItems {
+		actual, ok, err := table.Lookup(item.Key)
+		if err != nil || !ok || actual != item {
+			t.Fatalf("Lookup(%q): expected %v, got (%v, %t, %v)", item.Key, item, actual, ok, err)
+		}
+		if _, ok, err := table.Lookup(item.Key + "a"); err != nil || ok {
+			t.Fatalf("Expected key %q not to exist (err %v)", item.Key+"a", err)
+		}
+	}
+	// the partitions are read through the cache
+	if stats := cache.Stats(); stats.Hits == 0 {
+		t.Fatalf("Expected the index partitions to be cached, got %+v", stats)
+	}
+
+	// and kept decoded, even by a table that wasn't given a cache, so that
+	// seeking one that's cached reads and allocates nothing
+	uncached, err := LoadTable(tmpfile)
+	if err != nil {
+		t.Fatalf("Error loading Table: %v", err)
+	}
+	defer uncached.Close()
+	for _, table := range []*Table{table, uncached} {
+		key := sortedItems[len(sortedItems)/2].Key
+		if _, err := table.seekIndex(nil, key); err != nil {
+			t.Fatal(err)
+		}
+		allocs := testing.AllocsPerRun(100, func() {
+			if index, err := table.seekIndex(nil, key); err != nil || !index.valid() {
+				t.Fatalf("Expected an index entry for %q (err %v)", key, err)
+			}
+		})
+		if allocs > 0 {
+			t.Fatalf("Expected seeking a cached partition not to allocate, got %v allocations", allocs)
+		}
+	}
+
+	// scans that start and end anywhere, crossing partitions on the way
+	for _, bounds := range [][2]int{{0, len(sortedItems) - 1}, {1, 2}, {500, 7000}, {12345, 19999}, {19999, 19999}} {
+		startKey := sortedItems[bounds[0]].Key[:len(sortedItems[bounds[0]].Key)-1]
+		endKey := sortedItems[bounds[1]].Key
+		start := sort.Search(len(sortedItems), func(i int) bool { return sortedItems[i].Key >= startKey })
+		iter, err := table.RangeScan(startKey, endKey)
+		if err != nil {
+			t.Fatalf("Error creating RangeScan: %v", err)
+		}
+		var actualScan []Item
+		for ; iter.Valid(); iter.Next() {
+			actualScan = append(actualScan, iter.Item())
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatalf("Error during RangeScan: %v", err)
+		}
+		if !reflect.DeepEqual(sortedItems[start:bounds[1]+1], actualScan) {
+			t.Fatalf("Unexpected RangeScan result for [%q, %q]", startKey, endKey)
+		}
+	}
+}
+
+// BenchmarkIndexSeek measures finding the block that may hold a key, without
+// reading the block, with the whole index in memory and with a partitioned
+// one.
+func BenchmarkIndexSeek(b *testing.B) {
+	sortedItems := generateSortedItems(100000)
+	for _, test := range []struct {
+		name          string
+		partitionSize int
+	}{
+		{"flat", 0},
+		{"partitioned", 4096},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			tmpfile := filepath.Join(b.TempDir(), "tmpfile")
+			opts := &Options{Compression: NoCompression, IndexPartitionSize: test.partitionSize}
+			if err := BuildWithOptions(tmpfile, sortedItems, opts); err != nil {
+				b.Fatalf("Error building Table: %v", err)
+			}
+			table, err := LoadTable(tmpfile)
+			if err != nil {
+				b.Fatalf("Error loading Table: %v", err)
+			}
+			defer table.Close()
+
+			rng := rand.New(rand.NewSource(1))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := sortedItems[rng.Intn(len(sortedItems))].Key
+				if index, err := table.seekIndex(nil, key); err != nil || !index.valid() {
+					b.Fatalf("Expected an index entry for %q (err %v)", key, err)
+				}
+			}
+		})
+	}
+}
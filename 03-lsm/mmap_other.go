@@ -0,0 +1,18 @@
+//go:build !unix
+
+package table
+
+import (
+	"errors"
+	"os"
+)
+
+var errMmapUnsupported = errors.New("table: memory mapping isn't supported on this platform")
+
+func mmap(f *os.File) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmap(data []byte) error {
+	return errMmapUnsupported
+}
@@ -0,0 +1,196 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func scanAll(t testing.TB, table *Table) []Item {
+	iter, err := table.RangeScan("", "zzzzzzzzzzzzzzzzzzzz")
+	if err != nil {
+		t.Fatalf("Error creating RangeScan: %v", err)
+	}
+	var items []Item
+	for ; iter.Valid(); iter.Next() {
+		items = append(items, iter.Item())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("Error during RangeScan: %v", err)
+	}
+	return items
+}
+
+func TestTableMMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sortedItems := generateSortedItems(2000)
+	for i := range sortedItems {
+		// repeated values so that Snappy has something to compress
+		sortedItems[i].Value = strings.Repeat(sortedItems[i].Value, 3)
+		if i%6 == 0 {
+			sortedItems[i] = Item{Key: sortedItems[i].Key, Kind: KindTombstone}
+		}
+	}
+	for _, codec := range []Codec{Snappy, NoCompression} {
+		tmpfile := filepath.Join(dir, codec.Name())
+		if err := BuildWithOptions(tmpfile, sortedItems, &Options{Compression: codec}); err != nil {
+			t.Fatalf("Error building Table: %v", err)
+		}
+		fileTable, err := LoadTable(tmpfile)
+		if err != nil {
+			t.Fatalf("Error loading Table: %v", err)
+		}
+		defer fileTable.Close()
+		cache := NewCache(1 << 20)
+		mappedTable, err := LoadTableWithOptions(tmpfile, &Options{MMap: true, BlockCache: cache})
+		if err != nil {
+			t.Fatalf("Error loading Table: %v", err)
+		}
+
+		// every lookup, of keys that are there and of keys that aren't, gets
+		// the same result from both
+		keys := []string{"", "zzzzzzzzzzzzzzzzzzzz"}
+		for _, item := range sortedItems {
+			keys = append(keys, item.Key, item.Key+"a", item.Key[:len(item.Key)-1])
+		}
+		for _, key := range keys {
+			expected, expectedOk, err := fileTable.Lookup(key)
+			if err != nil {
+				t.Fatalf("Error performing point read for key %q: %v", key, err)
+			}
+			actual, ok, err := mappedTable.Lookup(key)
+			if err != nil || ok != expectedOk || actual != expected {
+				t.Fatalf("%v: Lookup(%q): expected (%v, %t), got (%v, %t, %v)", codec.Name(), key, expected, expectedOk, actual, ok, err)
+			}
+		}
+		if actual := scanAll(t, mappedTable); !reflect.DeepEqual(sortedItems, actual) {
+			t.Fatalf("%v: unexpected RangeScan result", codec.Name())
+		}
+		// only compressed blocks go through the cache; the others are read
+		// from the mapping every time
+		compressed := mappedTable.Properties().CompressedBlocks
+		if stats := cache.Stats(); (codec == Snappy) != (compressed > 0) || (compressed > 0) != (stats.Size > 0) {
+			t.Fatalf("%v: unexpected block cache stats %+v with %d compressed blocks", codec.Name(), stats, compressed)
+		}
+
+		// an open iterator keeps the mapping alive after the table is closed
+		iter, err := mappedTable.RangeScan("", "zzzzzzzzzzzzzzzzzzzz")
+		if err != nil {
+			t.Fatalf("Error creating RangeScan: %v", err)
+		}
+		if err := mappedTable.Close(); err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for ; iter.Valid(); iter.Next() {
+			count++
+		}
+		if err := iter.Err(); err != nil || count != len(sortedItems) {
+			t.Fatalf("RangeScan returned %d items, expected %d (err %v)", count, len(sortedItems), err)
+		}
+		if _, _, err := mappedTable.Get(sortedItems[1].Key); err == nil {
+			t.Fatalf("Expected Get on a closed table to fail")
+		}
+	}
+}
+
+func TestTableMMapCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, sortedItems := buildCorruptibleTable(t, dir, nil)
+	path := filepath.Join(dir, "corrupt")
+	// damage the first data block, which the metadata doesn't depend on
+	data[10] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	table, err := LoadTableWithOptions(path, &Options{MMap: true})
+	if err != nil {
+		t.Fatalf("Error loading Table: %v", err)
+	}
+	defer table.Close()
+	if _, _, err := table.Lookup(sortedItems[0].Key); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("Expected ErrCorruption, got %v", err)
+	}
+}
+
+func loadBenchmarkTables(b *testing.B, codec Codec) (map[string]*Table, []Item) {
+	dir := b.TempDir()
+	tmpfile := filepath.Join(dir, "tmpfile")
+	sortedItems := generateSortedItems(50000)
+	for i := range sortedItems {
+		sortedItems[i].Value = strings.Repeat(sortedItems[i].Value, 3)
+	}
+	if err := BuildWithOptions(tmpfile, sortedItems, &Options{Compression: codec}); err != nil {
+		b.Fatalf("Error building Table: %v", err)
+	}
+	tables := make(map[string]*Table)
+	for name, opts := range map[string]*Options{
+		"file":       nil,
+		"file+cache": {BlockCache: NewCache(64 << 20)},
+		"mmap":       {MMap: true},
+		"mmap+cache": {MMap: true, BlockCache: NewCache(64 << 20)},
+	} {
+		table, err := LoadTableWithOptions(tmpfile, opts)
+		if err != nil {
+			b.Fatalf("Error loading Table: %v", err)
+		}
+		b.Cleanup(func() { table.Close() })
+		tables[name] = table
+	}
+	return tables, sortedItems
+}
+
+var benchmarkReaders = []string{"file", "file+cache", "mmap", "mmap+cache"}
+
+func BenchmarkTableGet(b *testing.B) {
+	for _, codec := range []Codec{NoCompression, Snappy} {
+		tables, sortedItems := loadBenchmarkTables(b, codec)
+		for _, reader := range benchmarkReaders {
+			table := tables[reader]
+			b.Run(fmt.Sprintf("%v/%v", codec.Name(), reader), func(b *testing.B) {
+				rng := rand.New(rand.NewSource(1))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					item := sortedItems[rng.Intn(len(sortedItems))]
+					if _, ok, err := table.Get(item.Key); err != nil || !ok {
+						b.Fatalf("Key %q: expected value, got (%t, %v)", item.Key, ok, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkTableRangeScan(b *testing.B) {
+	for _, codec := range []Codec{NoCompression, Snappy} {
+		tables, sortedItems := loadBenchmarkTables(b, codec)
+		for _, reader := range benchmarkReaders {
+			table := tables[reader]
+			b.Run(fmt.Sprintf("%v/%v", codec.Name(), reader), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if items := scanAll(b, table); len(items) != len(sortedItems) {
+						b.Fatalf("RangeScan returned %d items, expected %d", len(items), len(sortedItems))
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package table
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmap maps the whole of f into memory, read only.
+func mmap(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,195 @@
+package table
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+/*
+properties_block format: a data block whose keys are property names, sorted.
+
+Numbers are stored as uvarints, and so is the creation time, in seconds since
+the Unix epoch. Names the reader doesn't know are skipped, so properties can be
+added without changing the format.
+*/
+
+const (
+	PROPERTY_COMPRESSION       = "table.compression"
+	PROPERTY_CREATION_TIME     = "table.creation_time"
+	PROPERTY_DATA_BLOCKS       = "table.data.blocks"
+	PROPERTY_DATA_SIZE         = "table.data.size"
+	PROPERTY_RAW_DATA_SIZE     = "table.data.raw_size"
+	PROPERTY_COMPRESSED_BLOCKS = "table.data.compressed_blocks"
+	PROPERTY_INDEX_PARTITIONS  = "table.index.partitions"
+	PROPERTY_NUM_ENTRIES       = "table.num_entries"
+	PROPERTY_NUM_TOMBSTONES    = "table.num_tombstones"
+	PROPERTY_NUM_RANGE_DELS    = "table.num_range_deletions"
+	PROPERTY_RAW_KEY_SIZE      = "table.raw_key_size"
+	PROPERTY_RAW_VALUE_SIZE    = "table.raw_value_size"
+	PROPERTY_SMALLEST_KEY      = "table.smallest_key"
+	PROPERTY_LARGEST_KEY       = "table.largest_key"
+	PROPERTY_SMALLEST_SEQ      = "table.smallest_seq"
+	PROPERTY_LARGEST_SEQ       = "table.largest_seq"
+)
+
+// Properties describe a table as a whole, and are loaded along with its
+// index. Tables written before a property was added read it as the zero
+// value.
+type Properties struct {
+	// Name of the codec the table was written with.
+	Compression string
+	// When the table was written, to the second.
+	CreationTime time.Time
+
+	DataBlocks uint64
+	// Number of data blocks that were stored compressed. The rest were left
+	// as they were since compressing them didn't save enough space.
+	CompressedBlocks uint64
+	// Size of the data blocks as stored, and before they were compressed.
+	DataSize    uint64
+	RawDataSize uint64
+	// Number of partitions the index is split into, or 0 when it isn't.
+	IndexPartitions uint64
+
+	// Number of entries, tombstones included, and how many of them are
+	// tombstones.
+	NumEntries    uint64
+	NumTombstones uint64
+	// Number of range tombstones, which aren't counted as entries.
+	NumRangeDeletions uint64
+	// Total size of the keys and of the values, before prefix compression
+	// and compression.
+	RawKeySize   uint64
+	RawValueSize uint64
+	// The first and last keys in the table, not counting the ranges of its
+	// range tombstones. Both are empty when the table has no entries. Unlike
+	// the other properties, they're worked out when a table written before
+	// they were recorded is loaded.
+	SmallestKey string
+	LargestKey  string
+
+	// Range of sequence numbers of the entries and range tombstones. Both are
+	// 0 when the writer didn't number its writes.
+	SmallestSeq uint64
+	LargestSeq  uint64
+}
+
+// CompressionRatio returns how many times larger the data blocks would be
+// without compression.
+func (p *Properties) CompressionRatio() float64 {
+	if p.DataSize == 0 {
+		return 1
+	}
+	return float64(p.RawDataSize) / float64(p.DataSize)
+}
+
+// numbers returns the properties that are stored as numbers, by name.
+func (p *Properties) numbers() map[string]*uint64 {
+	return map[string]*uint64{
+		PROPERTY_DATA_BLOCKS:       &p.DataBlocks,
+		PROPERTY_COMPRESSED_BLOCKS: &p.CompressedBlocks,
+		PROPERTY_DATA_SIZE:         &p.DataSize,
+		PROPERTY_RAW_DATA_SIZE:     &p.RawDataSize,
+		PROPERTY_INDEX_PARTITIONS:  &p.IndexPartitions,
+		PROPERTY_NUM_ENTRIES:       &p.NumEntries,
+		PROPERTY_NUM_TOMBSTONES:    &p.NumTombstones,
+		PROPERTY_NUM_RANGE_DELS:    &p.NumRangeDeletions,
+		PROPERTY_RAW_KEY_SIZE:      &p.RawKeySize,
+		PROPERTY_RAW_VALUE_SIZE:    &p.RawValueSize,
+		PROPERTY_SMALLEST_SEQ:      &p.SmallestSeq,
+		PROPERTY_LARGEST_SEQ:       &p.LargestSeq,
+	}
+}
+
+// strings returns the properties that are stored as strings, by name.
+func (p *Properties) strings() map[string]*string {
+	return map[string]*string{
+		PROPERTY_COMPRESSION:  &p.Compression,
+		PROPERTY_SMALLEST_KEY: &p.SmallestKey,
+		PROPERTY_LARGEST_KEY:  &p.LargestKey,
+	}
+}
+
+// add accounts for an item written to the table. Items are added in order.
+func (p *Properties) add(item Item) {
+	if p.NumEntries == 0 {
+		p.SmallestKey = item.Key
+	}
+	p.addSeq(item.Seq)
+	p.LargestKey = item.Key
+	p.NumEntries++
+	if item.Kind == KindTombstone {
+		p.NumTombstones++
+	}
+	p.RawKeySize += uint64(len(item.Key))
+	p.RawValueSize += uint64(len(item.Value))
+}
+
+// addRangeTombstone accounts for a range tombstone written to the table.
+func (p *Properties) addRangeTombstone(r RangeTombstone) {
+	p.addSeq(r.Seq)
+	p.NumRangeDeletions++
+}
+
+func (p *Properties) addSeq(seq uint64) {
+	if p.NumEntries == 0 && p.NumRangeDeletions == 0 {
+		p.SmallestSeq, p.LargestSeq = seq, seq
+	}
+	p.SmallestSeq = min(p.SmallestSeq, seq)
+	p.LargestSeq = max(p.LargestSeq, seq)
+}
+
+func (p *Properties) encode() []byte {
+	var items []Item
+	for name, value := range p.strings() {
+		items = append(items, Item{Key: name, Value: *value})
+	}
+	for name, value := range p.numbers() {
+		items = append(items, Item{Key: name, Value: string(binary.AppendUvarint(nil, *value))})
+	}
+	if !p.CreationTime.IsZero() {
+		creationTime := binary.AppendUvarint(nil, uint64(p.CreationTime.Unix()))
+		items = append(items, Item{Key: PROPERTY_CREATION_TIME, Value: string(creationTime)})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+
+	block := newBlockBuilder(DEFAULT_BLOCK_RESTART_INTERVAL)
+	for _, item := range items {
+		block.add(item)
+	}
+	return block.finish()
+}
+
+func (t *Table) decodeProperties(offset int64, data []byte) error {
+	block, err := t.newBlockIterator(offset, data)
+	if err != nil {
+		return err
+	}
+	var creationTime uint64
+	numbers := t.properties.numbers()
+	numbers[PROPERTY_CREATION_TIME] = &creationTime
+	strings := t.properties.strings()
+	for {
+		item, ok, err := block.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if s, known := strings[item.Key]; known {
+			*s = item.Value
+		} else if number, known := numbers[item.Key]; known {
+			value, n := binary.Uvarint([]byte(item.Value))
+			if n != len(item.Value) {
+				return t.corruption(offset, "malformed property "+item.Key)
+			}
+			*number = value
+		}
+	}
+	if creationTime != 0 {
+		t.properties.CreationTime = time.Unix(int64(creationTime), 0)
+	}
+	return nil
+}
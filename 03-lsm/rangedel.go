@@ -0,0 +1,67 @@
+package table
+
+import (
+	"sort"
+)
+
+/*
+range deletion block format: a data block with an entry for each range
+tombstone, keyed by the start of its range, whose value is the end of the
+range. Entries are sorted by start and then from the highest sequence number
+down, and are all of KindTombstone.
+*/
+
+// RangeTombstone records that every key in [Start, End] was deleted by the
+// write with sequence number Seq. It shadows the entries for those keys with
+// lower sequence numbers, whichever table they're in.
+type RangeTombstone struct {
+	Start, End string
+	Seq        uint64
+}
+
+// Contains reports whether key is in the tombstone's range.
+func (r RangeTombstone) Contains(key string) bool {
+	return r.Start <= key && key <= r.End
+}
+
+// Covers reports whether the tombstone deletes item.
+func (r RangeTombstone) Covers(item Item) bool {
+	return r.Contains(item.Key) && item.Seq < r.Seq
+}
+
+func encodeRangeTombstones(tombstones []RangeTombstone) []byte {
+	sorted := append([]RangeTombstone(nil), tombstones...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Start != sorted[j].Start {
+			return sorted[i].Start < sorted[j].Start
+		}
+		return sorted[i].Seq > sorted[j].Seq
+	})
+
+	block := newBlockBuilder(DEFAULT_BLOCK_RESTART_INTERVAL)
+	for _, r := range sorted {
+		block.add(Item{Key: r.Start, Value: r.End, Kind: KindTombstone, Seq: r.Seq})
+	}
+	return block.finish()
+}
+
+func (t *Table) decodeRangeTombstones(offset int64, data []byte) ([]RangeTombstone, error) {
+	block, err := t.newBlockIterator(offset, data)
+	if err != nil {
+		return nil, err
+	}
+	var tombstones []RangeTombstone
+	for {
+		item, ok, err := block.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return tombstones, nil
+		}
+		if item.Kind != KindTombstone || item.Key > item.Value {
+			return nil, t.corruption(offset, "malformed range tombstone")
+		}
+		tombstones = append(tombstones, RangeTombstone{Start: item.Key, End: item.Value, Seq: item.Seq})
+	}
+}
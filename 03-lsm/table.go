@@ -1,163 +1,166 @@
 package table
 
 import (
-	"bufio"
-	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"log"
+	"math"
 	"os"
-	"strconv"
-	"strings"
+)
+
+// Kind distinguishes live values from tombstones, which record that a key
+// has been deleted and shadow any value for it in older tables.
+type Kind byte
 
-	"../skip_list"
+const (
+	KindValue Kind = iota
+	KindTombstone
 )
 
 type Item struct {
 	Key, Value string
+	// The zero value is KindValue. The Value of a tombstone is empty.
+	Kind Kind
+	// Sequence number of the write that stored the entry, for callers that
+	// keep several versions of a key. Entries of version 1 tables read back
+	// with 0.
+	Seq uint64
 }
 
+// MAX_SEQUENCE is larger than any sequence number, so that a lookup as of it
+// finds the newest entry.
+const MAX_SEQUENCE = math.MaxUint64
+
 const (
-	MAX_BLOCK_SIZE    = 4096
-	KEY_LENGTH_SIZE   = 4
-	VALUE_LENGTH_SIZE = 4
+	MAX_BLOCK_SIZE  = 4096
+	KIND_SIZE       = 1
+	KEY_LENGTH_SIZE = 4
+	// compression_type and checksum
+	BLOCK_TRAILER_SIZE = 5
 )
 
 type indexEntry struct {
 	key       string
-	offset    uint32
-	blockSize uint32
-	itemCount uint32
+	offset    uint64
+	blockSize uint64
+	itemCount uint64
 }
 
-/*
-file format:
-data_block data_block ... data_block
-index_entry index_entry ... index_entry
-index_offset index_entry_#
-
-data_block format:
-key_size, key, value_size, value
-
-index_entry format:
-key_size, key, offset, block_size
-*/
+// Options control how tables are written and read. A nil *Options uses the
+// defaults.
+type Options struct {
+	// Number of bits per key in the Bloom filter. Zero uses
+	// DEFAULT_BLOOM_BITS_PER_KEY and a negative value leaves the filter out.
+	BloomBitsPerKey int
+
+	// Number of entries between restart points in a data block. Zero uses
+	// DEFAULT_BLOCK_RESTART_INTERVAL; 1 turns prefix compression off.
+	BlockRestartInterval int
+
+	// Split the index into partitions of about this many bytes, which are
+	// only read as they're needed, and hold just a top-level index over them
+	// in memory. Worth it for tables with so many blocks that their index
+	// takes up too much memory. Zero keeps the whole index in memory.
+	IndexPartitionSize int
+
+	// Codec the data blocks are compressed with. nil uses Snappy, and
+	// NoCompression turns compression off.
+	Compression Codec
+
+	// Cache for the data blocks and index partitions read from the table,
+	// usually shared with other tables. nil reads every data block from the
+	// file, and keeps up to PARTITION_CACHE_SIZE bytes of index partitions in
+	// a cache of the table's own.
+	BlockCache *Cache
+
+	// Cache limiting how many files are kept open, usually shared with other
+	// tables. nil keeps the file open until the table is closed.
+	FileCache *FileCache
+
+	// Map the file into memory and serve reads from the mapping instead of
+	// reading each block from the file. The file stays open and mapped until
+	// the table is closed, whatever FileCache says. Blocks that aren't
+	// compressed are used where they lie, and never go through BlockCache.
+	MMap bool
+}
 
-// Given a sorted list of key/value pairs, write them out according to the format you designed.
-func Build(path string, sortedItems []Item) error {
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-	if err != nil {
-		return err
+func (o *Options) bloomBitsPerKey() int {
+	if o == nil || o.BloomBitsPerKey == 0 {
+		return DEFAULT_BLOOM_BITS_PER_KEY
 	}
+	return o.BloomBitsPerKey
+}
 
-	defer f.Close()
-
-	buf := new(bytes.Buffer)
-
-	totalBytesWritten := 0
-	footer := []indexEntry{}
-	itemCount := 0
-	var lastWrittenKey string
-
-	for _, item := range sortedItems {
-		// this block if full. need to flush, clean up, and start a new one
-		if buf.Len() > MAX_BLOCK_SIZE {
-			// flush to file
-			bytesWritten, writeErr := flushBlockToFile(f, buf)
-			if writeErr != nil {
-				return writeErr
-			}
-			// set up index entry
-			footer = append(footer, indexEntry{
-				key:       lastWrittenKey,
-				offset:    uint32(totalBytesWritten),
-				blockSize: uint32(bytesWritten),
-				itemCount: uint32(itemCount),
-			})
-			totalBytesWritten += bytesWritten
-			itemCount = 0
-		}
-
-		if item.Key == "dbofierrjmj" {
-			fmt.Printf("I exist!\n")
-		}
-
-		// put bytes for this item in the byteArr for future write
-		keyBytes := []byte(item.Key)
-		valBytes := []byte(item.Value)
-
-		keySizeBytes := make([]byte, KEY_LENGTH_SIZE)
-		binary.BigEndian.PutUint32(keySizeBytes, uint32(len(keyBytes)))
-
-		buf.Write(keySizeBytes)
-		buf.Write(keyBytes)
-
-		valSizeBytes := make([]byte, VALUE_LENGTH_SIZE)
-		binary.BigEndian.PutUint32(valSizeBytes, uint32(len(valBytes)))
+func (o *Options) blockRestartInterval() int {
+	if o == nil || o.BlockRestartInterval <= 0 {
+		return DEFAULT_BLOCK_RESTART_INTERVAL
+	}
+	return o.BlockRestartInterval
+}
 
-		buf.Write(valSizeBytes)
-		buf.Write(valBytes)
-		itemCount++
-		lastWrittenKey = item.Key
-		fmt.Printf("item count %d\n", itemCount)
+func (o *Options) indexPartitionSize() int {
+	if o == nil || o.IndexPartitionSize < 0 {
+		return 0
 	}
+	return o.IndexPartitionSize
+}
 
-	if buf.Len() > 0 {
-		bytesWritten, writeErr := flushBlockToFile(f, buf)
-		if writeErr != nil {
-			return writeErr
-		}
-		// set up index entry
-		footer = append(footer, indexEntry{
-			key:       lastWrittenKey,
-			offset:    uint32(totalBytesWritten),
-			blockSize: uint32(bytesWritten),
-			itemCount: uint32(itemCount),
-		})
-		totalBytesWritten += bytesWritten
+func (o *Options) compression() Codec {
+	if o == nil || o.Compression == nil {
+		return Snappy
 	}
+	return o.Compression
+}
+
+/*
+file format:
+data_block block_trailer data_block block_trailer ... data_block block_trailer
+index_partition block_trailer ... index_partition block_trailer
+filter_block block_trailer
+properties_block block_trailer
+metaindex_block block_trailer
+index_entry index_entry ... index_entry block_trailer
+footer
 
-	buf.Reset()
+filter_block is left out when the table has no Bloom filter, and there are
+only index partitions when the index is partitioned, in which case the index
+that follows the meta-index is the top-level index.
 
-	// write footer to the file
-	for _, entry := range footer {
-		keySizeBytes := make([]byte, KEY_LENGTH_SIZE)
-		binary.BigEndian.PutUint32(keySizeBytes, uint32(len(entry.key)))
+block_trailer format:
+compression_type, checksum
 
-		buf.Write(keySizeBytes)
-		buf.WriteString(entry.key)
+compression_type is the ID of the Codec the block was compressed with, and
+is 1 byte. Only data blocks are ever compressed. Each checksum is the CRC32C of
+everything between it and the previous one (or the start of the file), so
+every byte of the table is covered by exactly one of them.
 
-		offsetBytes := make([]byte, KEY_LENGTH_SIZE)
-		binary.BigEndian.PutUint32(offsetBytes, entry.offset)
-		buf.Write(offsetBytes)
+data_block format: see block.go
 
-		sizeBytes := make([]byte, KEY_LENGTH_SIZE)
-		binary.BigEndian.PutUint32(sizeBytes, entry.blockSize)
-		buf.Write(sizeBytes)
+properties_block format: see properties.go
 
-		countBytes := make([]byte, KEY_LENGTH_SIZE)
-		binary.BigEndian.PutUint32(countBytes, entry.itemCount)
-		buf.Write(countBytes)
-	}
+metaindex_block, index_entry and footer format: see footer.go
 
-	// flush footer bytes to file
-	footerBytesWritten, writeErr := f.Write(buf.Bytes())
-	if writeErr != nil {
-		return writeErr
-	}
-	log.Printf("Written %d footer bytes\n", footerBytesWritten)
+index_partition format: see index.go
+*/
 
-	// write index_offset
-	if err = binary.Write(f, binary.BigEndian, uint32(totalBytesWritten)); err != nil {
+// Given a sorted list of key/value pairs, write them out according to the format you designed.
+func Build(path string, sortedItems []Item) error {
+	return BuildWithOptions(path, sortedItems, nil)
+}
+
+func BuildWithOptions(path string, sortedItems []Item, opts *Options) error {
+	b, err := NewTableBuilder(path, opts)
+	if err != nil {
 		return err
 	}
-	// write index_entry_#
-	if err = binary.Write(f, binary.BigEndian, uint32(len(footer))); err != nil {
-		return err
+	for _, item := range sortedItems {
+		if err := b.AddItem(item); err != nil {
+			b.Abandon()
+			return err
+		}
 	}
-
-	return nil
+	return b.Finish()
 }
 
 // A Table provides efficient access into sorted key/value data that's organized according
@@ -165,182 +168,649 @@ func Build(path string, sortedItems []Item) error {
 //
 // Although a Table shouldn't keep all the key/value data in memory, it should contain
 // some metadata to help with efficient access (e.g. size, index, optional Bloom filter).
+//
+// A Table is safe for concurrent use: nothing but its caches changes once it's
+// loaded, and they have locks of their own. Each iterator may only be used by
+// one goroutine at a time.
 type Table struct {
-	BlockIndex *skip_list.SkipListOC
-	FilePath   string
+	FilePath string
+
+	// The file stays readable for as long as the Table is in use, even
+	// after it has been removed from the directory; see FileCache.
+	handle *fileHandle
+	// the whole file when it's mapped into memory, which is only valid while
+	// handle is held
+	mapped []byte
+	// identifies the table's blocks in the cache
+	id    uint64
+	cache *Cache
+	// holds the decoded index partitions: cache if there is one, and
+	// otherwise one of the table's own
+	partitionCache *Cache
+	// version of the format the table was written in
+	formatVersion int
+	// nil when the table was built without a Bloom filter
+	filter     bloomFilter
+	properties Properties
+	// sorted by start, and held in memory since every read needs them
+	rangeDels []RangeTombstone
+	// an entry for each data block, sorted by key, or for each index
+	// partition when the index is partitioned
+	index []indexEntry
+	// offset just past the last data block
+	dataEnd uint64
 }
 
 // Prepares a Table for efficient access. This will likely involve reading some metadata
 // in order to populate the fields of the Table struct.
 func LoadTable(path string) (*Table, error) {
+	return LoadTableWithOptions(path, nil)
+}
+
+// Only the cache options apply to reading a table; the rest are recorded in
+// the table itself.
+func LoadTableWithOptions(path string, opts *Options) (*Table, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	table, err := loadTable(f, path)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var files *FileCache
+	if opts != nil {
+		table.cache = opts.BlockCache
+		files = opts.FileCache
+	}
+	table.partitionCache = table.cache
+	if table.partitionCache == nil && table.partitioned() {
+		table.partitionCache = NewCache(PARTITION_CACHE_SIZE)
+	}
+	// the metadata was read from the file, so none of it points into the
+	// mapping, which goes away when the table is closed
+	if opts != nil && opts.MMap {
+		if table.mapped, err = mmap(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		files = nil
+	}
+	table.handle = newFileHandle(f, path, files)
+	table.handle.mapped = table.mapped
+	table.id = nextTableID.Add(1)
+	return table, nil
+}
+
+// Properties returns the statistics recorded when the table was built.
+func (t *Table) Properties() Properties {
+	return t.properties
+}
 
-	fileReader := bufio.NewReader(f)
+// RangeTombstones returns the range tombstones recorded in the table, sorted
+// by the start of their range. The caller must not modify them.
+func (t *Table) RangeTombstones() []RangeTombstone {
+	return t.rangeDels
+}
+
+// Releases the file held open by the Table. Iterators that are still open
+// keep it open until they reach their end.
+func (t *Table) Close() error {
+	return t.handle.close()
+}
 
-	f.Seek(-8, io.SeekEnd)
-	buf := make([]byte, 4)
+func loadTable(f *os.File, path string) (*Table, error) {
+	table := Table{FilePath: path}
 
-	if _, err = io.ReadFull(fileReader, buf); err != nil {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	ft, footerOffset, err := table.readFooter(f, info.Size())
+	if err != nil {
 		return nil, err
 	}
+	table.formatVersion = ft.version
 
-	indexOffset := binary.BigEndian.Uint32(buf)
-	log.Printf("Index offset: %d", indexOffset)
+	if !ft.index.within(uint64(footerOffset)) {
+		return nil, table.corruption(footerOffset, "footer points outside the file")
+	}
+	// the data blocks come first, and every other block after them
+	dataEnd := ft.index.offset
+	meta := ft.meta
+	if ft.version > 1 {
+		if !ft.metaIndex.within(uint64(footerOffset)) {
+			return nil, table.corruption(footerOffset, "footer points outside the file")
+		}
+		buf, err := table.readBlockFrom(f, int64(ft.metaIndex.offset), int(ft.metaIndex.size))
+		if err != nil {
+			return nil, err
+		}
+		if meta, err = table.decodeMetaIndex(int64(ft.metaIndex.offset), buf); err != nil {
+			return nil, err
+		}
+		dataEnd = min(dataEnd, ft.metaIndex.offset)
+	}
+	for name, h := range meta {
+		if !h.within(uint64(footerOffset)) {
+			return nil, table.corruption(footerOffset, "block "+name+" points outside the file")
+		}
+		dataEnd = min(dataEnd, h.offset)
+	}
 
-	if _, err = io.ReadFull(fileReader, buf); err != nil {
-		return nil, err
+	if h, ok := meta[META_FILTER]; ok {
+		filter, err := table.readBlockFrom(f, int64(h.offset), int(h.size))
+		if err != nil {
+			return nil, err
+		}
+		if len(filter) > 0 {
+			table.filter = filter
+		}
 	}
-	numberOfIndexEntries := int(binary.BigEndian.Uint32(buf))
-	log.Printf("Index entry #: %d", numberOfIndexEntries)
 
-	table := Table{
-		BlockIndex: skip_list.NewSkipListOC(),
-		FilePath:   path,
+	if h, ok := meta[META_PROPERTIES]; ok {
+		properties, err := table.readBlockFrom(f, int64(h.offset), int(h.size))
+		if err != nil {
+			return nil, err
+		}
+		if err := table.decodeProperties(int64(h.offset), properties); err != nil {
+			return nil, err
+		}
 	}
 
-	f.Seek(int64(indexOffset), io.SeekStart)
+	if h, ok := meta[META_RANGE_DELETIONS]; ok {
+		data, err := table.readBlockFrom(f, int64(h.offset), int(h.size))
+		if err != nil {
+			return nil, err
+		}
+		if table.rangeDels, err = table.decodeRangeTombstones(int64(h.offset), data); err != nil {
+			return nil, err
+		}
+	}
 
-	for i := 0; i < numberOfIndexEntries; i++ {
-		entry, readIndexErr := readIndexEntry(f)
-		if readIndexErr != nil {
-			return nil, readIndexErr
+	// a partitioned index has its partitions right after the data blocks
+	if table.partitioned() && ft.version == 1 {
+		return nil, table.corruption(footerOffset, "partitioned index in a version 1 table")
+	}
+	index, err := table.readBlockFrom(f, int64(ft.index.offset), int(ft.index.size))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := table.decodeIndexEntries(int64(ft.index.offset), index, dataEnd)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(entries)) != ft.indexEntries {
+		return nil, table.corruption(footerOffset, fmt.Sprintf("footer counts %d index entries, found %d", ft.indexEntries, len(entries)))
+	}
+	table.index = entries
+	if table.partitioned() {
+		for i := range entries {
+			dataEnd = min(dataEnd, entries[i].offset)
 		}
-		fmt.Printf("Index entry %v %d\n", entry.key, entry.offset)
-		table.BlockIndex.Put(entry.key, fmt.Sprintf("%v-%v-%v", strconv.Itoa(int(entry.offset)), strconv.Itoa(int(entry.blockSize)), strconv.Itoa(int(entry.itemCount))))
+	}
+	table.dataEnd = dataEnd
+
+	// tables written before the key range was recorded have it worked out
+	// from the index and the first block
+	if table.properties.NumEntries == 0 && len(table.index) > 0 {
+		first := &table.index[0]
+		data, err := table.readBlockFrom(f, int64(first.offset), int(first.blockSize))
+		if err != nil {
+			return nil, err
+		}
+		block, err := table.newBlockIterator(int64(first.offset), data)
+		if err != nil {
+			return nil, err
+		}
+		item, ok, err := block.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, table.corruption(int64(first.offset), "empty data block")
+		}
+		table.properties.SmallestKey = item.Key
+		table.properties.LargestKey = table.index[len(table.index)-1].key
 	}
 
 	return &table, nil
 }
 
+// The second return value will be `false` when the key isn't in the table or
+// the table holds a tombstone for it, or a range tombstone that covers it;
+// use Lookup to tell them apart.
 func (t *Table) Get(key string) (string, bool, error) {
+	item, ok, err := t.Lookup(key)
+	if err != nil || !ok || item.Kind == KindTombstone {
+		return "", false, err
+	}
+	for _, r := range t.rangeDels {
+		if r.Covers(item) {
+			return "", false, nil
+		}
+	}
+	return item.Value, true, nil
+}
 
-	fmt.Printf("Looking for %v\n", key)
+// Lookup returns the newest entry stored for key, which may be a tombstone.
+// The second return value will be `false` when the table has no entry for
+// key. Range tombstones are left to the caller, like for RangeScan; see
+// RangeTombstones.
+func (t *Table) Lookup(key string) (Item, bool, error) {
+	return t.LookupAt(key, MAX_SEQUENCE)
+}
 
-	// find the index block where the key might be
-	indexNode := t.BlockIndex.FirstGE(key, nil)
-	if indexNode == nil {
-		return "", false, nil
+// LookupAt is like Lookup, but ignores the entries whose sequence number is
+// greater than seq.
+func (t *Table) LookupAt(key string, seq uint64) (Item, bool, error) {
+	// most lookups of missing keys end here, without reading any block
+	if t.filter != nil && !t.filter.mayContain(key) {
+		return Item{}, false, nil
 	}
 
-	valueParts := strings.Split(indexNode.Item.Value, "-")
-	offset, _ := strconv.Atoi(valueParts[0])
-	size, _ := strconv.Atoi(valueParts[1])
-	count, _ := strconv.Atoi(valueParts[2])
-
-	log.Printf("Offset %d Size %d Count %d \n", offset, size, count)
+	// a mapped block can only be read while the file is held
+	var f *os.File
+	if t.mapped != nil {
+		var err error
+		if f, err = t.handle.acquire(); err != nil {
+			return Item{}, false, err
+		}
+		defer t.handle.release()
+	}
 
-	f, err := os.Open(t.FilePath)
+	// find the block where the key might be
+	index, err := t.seekIndex(f, key)
 	if err != nil {
-		return "", false, nil
+		return Item{}, false, err
+	}
+	for index.valid() {
+		entry := index.current()
+		blockBuf, err := t.readBlock(f, int64(entry.offset), int(entry.blockSize))
+		if err != nil {
+			return Item{}, false, err
+		}
+		block, err := t.newBlockIterator(int64(entry.offset), blockBuf)
+		if err != nil {
+			return Item{}, false, err
+		}
+		item, ok, err := block.seek(key)
+		for ok && item.Key == key && item.Seq > seq {
+			item, ok, err = block.next()
+		}
+		if err != nil {
+			return Item{}, false, err
+		}
+		if ok {
+			if item.Key != key {
+				return Item{}, false, nil
+			}
+			return item, true, nil
+		}
+		// every version in the block was too new, and older ones may
+		// carry on into the next
+		if err := index.next(); err != nil {
+			return Item{}, false, err
+		}
 	}
-	defer f.Close()
+	return Item{}, false, nil
+}
 
-	blockBuf := make([]byte, size)
-	if _, readAtErr := f.ReadAt(blockBuf, int64(offset)); readAtErr != nil {
-		return "", false, readAtErr
+// startKey and endKey are inclusive. Every version of each key is produced,
+// newest first, including the ones a range tombstone covers. Blocks are read
+// from disk one at a time as the iterator advances, so a scan never holds
+// more than a single block in memory.
+func (t *Table) RangeScan(startKey, endKey string) (Iterator, error) {
+	iter := &tableIterator{t: t, startKey: startKey, endKey: endKey}
+	iter.SeekToFirst()
+	if err := iter.Err(); err != nil {
+		return nil, err
 	}
+	return iter, nil
+}
 
-	items := deserializeBlock(blockBuf, count)
-	for i := 0; i < count; i++ {
-		if items[i].Key == key {
-			return items[i].Value, true, nil
+// readBlock returns the data block at the given offset, from the cache if
+// it's there. f is the table's file if the caller is already holding it open,
+// and nil otherwise.
+func (t *Table) readBlock(f *os.File, offset int64, size int) ([]byte, error) {
+	key := cacheKey{t.id, offset}
+	if data, ok := t.cache.get(key); ok {
+		return data.([]byte), nil
+	}
+	if f == nil {
+		var err error
+		if f, err = t.handle.acquire(); err != nil {
+			return nil, err
 		}
+		defer t.handle.release()
 	}
-	return "", false, nil
+	data, err := t.readBlockFrom(f, offset, size)
+	if err != nil {
+		return nil, err
+	}
+	// a block that's used where it lies in the mapping would only take up
+	// room in the cache
+	if t.mapped == nil || t.mapped[offset+int64(size)] != NO_COMPRESSION_ID {
+		t.cache.add(key, data, int64(len(data)))
+	}
+	return data, nil
 }
 
-func (t *Table) RangeScan(startKey, endKey string) (Iterator, error) {
-	return nil, nil
+// readBlockFrom reads the block at the given offset, checks it against the
+// checksum that follows and decompresses it.
+func (t *Table) readBlockFrom(f *os.File, offset int64, size int) ([]byte, error) {
+	var blockBuf []byte
+	if t.mapped != nil {
+		end := offset + int64(size) + BLOCK_TRAILER_SIZE
+		if end > int64(len(t.mapped)) {
+			return nil, t.corruption(offset, "block extends past the end of the file")
+		}
+		blockBuf = t.mapped[offset:end:end]
+	} else {
+		blockBuf = make([]byte, size+BLOCK_TRAILER_SIZE)
+		if _, err := f.ReadAt(blockBuf, offset); err != nil {
+			if err == io.EOF {
+				return nil, t.corruption(offset, "block extends past the end of the file")
+			}
+			return nil, err
+		}
+	}
+	if !checksumMatches(blockBuf) {
+		return nil, t.corruption(offset, "block checksum mismatch")
+	}
+	compressionType := blockBuf[size]
+	if compressionType == NO_COMPRESSION_ID {
+		return blockBuf[:size], nil
+	}
+	codec, ok := codecs[compressionType]
+	if !ok {
+		return nil, fmt.Errorf("%v: block at offset %d uses unknown compression type %d", t.FilePath, offset, compressionType)
+	}
+	data, err := codec.Decompress(blockBuf[:size])
+	if err != nil {
+		return nil, t.corruption(offset, fmt.Sprintf("decompressing block: %v", err))
+	}
+	return data, nil
 }
 
 type Iterator interface {
 	// Advances to the next item in the range. Assumes Valid() == true.
 	Next()
 
+	// Moves back to the previous item in the range. Assumes Valid() == true.
+	Prev()
+
+	// Moves to the first item whose key is >= key, or to the first item in
+	// the range if key comes before it.
+	Seek(key string)
+
+	// Moves to the first item in the range.
+	SeekToFirst()
+
+	// Moves to the last item in the range.
+	SeekToLast()
+
 	// Indicates whether the iterator is currently pointing to a valid item.
+	// Once it has run off either end of the range, it can only be
+	// repositioned by one of the Seek methods.
 	Valid() bool
 
-	// Returns the Item the iterator is currently pointing to. Assumes Valid() == true.
+	// Returns the Item the iterator is currently pointing to, which may be a
+	// tombstone. Assumes Valid() == true.
 	Item() Item
+
+	// Returns the error, if any, that made the iterator stop before the end
+	// of the range. Check it once Valid() == false. Repositioning the
+	// iterator clears it.
+	Err() error
+
+	// Lets go of what the iterator holds, such as the table's file. The
+	// iterator can't be used afterwards. A table iterator lets go of its file
+	// whenever it runs off either end, but one dropped before that keeps it
+	// open until it's closed.
+	Close()
+}
+
+// tableIterator holds the table's file open while it's positioned in its
+// range, and lets go of it once it runs off either end; seeking it again
+// after that fails if the table has been closed in the meantime.
+type tableIterator struct {
+	t *Table
+	// at the index entry of the block currently being read
+	index            indexIterator
+	block            *blockIterator
+	item             Item
+	valid            bool
+	startKey, endKey string
+	err              error
+	// the table's file, held open until the iterator is done; nil once it
+	// is
+	file *os.File
+}
+
+func (iter *tableIterator) Next() {
+	iter.check(iter.advance())
+}
+
+func (iter *tableIterator) Prev() {
+	iter.check(iter.retreat())
+}
+
+func (iter *tableIterator) Seek(key string) {
+	if key < iter.startKey {
+		key = iter.startKey
+	}
+	// most of the time there's nothing in range, the file isn't needed
+	if iter.t.searchIndex(key) == len(iter.t.index) {
+		iter.err = nil
+		iter.finish()
+		return
+	}
+	iter.check(iter.seek(key))
+}
+
+func (iter *tableIterator) SeekToFirst() {
+	iter.Seek(iter.startKey)
 }
 
-func flushBlockToFile(f *os.File, buffer *bytes.Buffer) (int, error) {
-	bytesWritten, writeErr := f.Write(buffer.Bytes())
-	if writeErr != nil {
-		return 0, writeErr
-	}
-
-	log.Printf("Written %d bytes\n", bytesWritten)
-
-	// start a new block
-	buffer.Reset()
-	return bytesWritten, nil
-}
-
-func deserializeBlock(blockBuf []byte, count int) []Item {
-	index := uint32(0)
-	items := make([]Item, count)
-	for i := 0; i < count; i++ {
-		keySize := binary.BigEndian.Uint32(blockBuf[index : index+4])
-		index += 4
-		keyEnd := index + keySize
-		key := string(blockBuf[index:keyEnd])
-		index += keySize
-		valSize := binary.BigEndian.Uint32(blockBuf[index : index+4])
-		index += 4
-		valEnd := index + valSize
-		val := string(blockBuf[index:valEnd])
-		index += valSize
-		items[i] = Item{
-			Key:   key,
-			Value: val,
+func (iter *tableIterator) SeekToLast() {
+	if iter.t.searchIndex(iter.startKey) == len(iter.t.index) {
+		iter.err = nil
+		iter.finish()
+		return
+	}
+	// the last item <= endKey comes just before the first one > endKey,
+	// unless there is none, in which case it's the last item in the table
+	err := iter.seek(iter.endKey + "\x00")
+	if err == nil {
+		if iter.valid {
+			err = iter.retreat()
+		} else {
+			err = iter.seekToLast()
 		}
 	}
-	for _, item := range items {
-		fmt.Printf("Key: %v Value %v\n", item.Key, item.Value)
+	iter.check(err)
+}
+
+func (iter *tableIterator) Valid() bool {
+	return iter.valid
+}
+
+func (iter *tableIterator) Item() Item {
+	return iter.item
+}
+
+func (iter *tableIterator) Close() {
+	iter.finish()
+}
+
+func (iter *tableIterator) Err() error {
+	return iter.err
+}
+
+// check ends the iteration if err is set or the iterator has left its range.
+func (iter *tableIterator) check(err error) {
+	if err != nil {
+		iter.err = err
+		iter.finish()
+	} else if !iter.valid || iter.item.Key < iter.startKey || iter.item.Key > iter.endKey {
+		iter.finish()
 	}
-	return items
 }
 
-func readIndexEntry(reader io.Reader) (*indexEntry, error) {
-	buf := make([]byte, 4)
-	if _, err := io.ReadFull(reader, buf); err != nil {
-		return nil, err
+// finish ends the iteration and lets go of the table's file.
+func (iter *tableIterator) finish() {
+	iter.valid = false
+	if iter.file != nil {
+		iter.t.handle.release()
+		iter.file = nil
 	}
-	keySize := binary.BigEndian.Uint32(buf)
+}
 
-	buf = make([]byte, keySize)
-	if _, err := io.ReadFull(reader, buf); err != nil {
-		return nil, err
+// acquire makes sure the iterator is holding the table's file.
+func (iter *tableIterator) acquire() error {
+	if iter.file != nil {
+		return nil
 	}
-	key := string(buf)
+	f, err := iter.t.handle.acquire()
+	if err != nil {
+		return err
+	}
+	iter.file = f
+	return nil
+}
 
-	buf = make([]byte, 4)
-	if _, err := io.ReadFull(reader, buf); err != nil {
-		return nil, err
+// seek positions the iterator at the first item whose key is >= key,
+// whatever the range.
+func (iter *tableIterator) seek(key string) error {
+	iter.err = nil
+	iter.valid = false
+	if err := iter.acquire(); err != nil {
+		return err
+	}
+	var err error
+	if iter.index, err = iter.t.seekIndex(iter.file, key); err != nil {
+		return err
+	}
+	if !iter.index.valid() {
+		return nil
+	}
+	if err := iter.loadBlock(); err != nil {
+		return err
 	}
-	indexOffset := binary.BigEndian.Uint32(buf)
+	// skip over the items in the block that precede key; the index
+	// guarantees the block holds a key >= key
+	iter.item, iter.valid, err = iter.block.seek(key)
+	return err
+}
 
-	buf = make([]byte, 4)
-	if _, err := io.ReadFull(reader, buf); err != nil {
-		return nil, err
+// seekToLast positions the iterator at the last item in the table.
+func (iter *tableIterator) seekToLast() error {
+	iter.err = nil
+	iter.valid = false
+	if err := iter.acquire(); err != nil {
+		return err
 	}
-	blockSize := binary.BigEndian.Uint32(buf)
+	var err error
+	if iter.index, err = iter.t.seekIndexToLast(iter.file); err != nil {
+		return err
+	}
+	if !iter.index.valid() {
+		return nil
+	}
+	if err := iter.loadBlock(); err != nil {
+		return err
+	}
+	iter.item, iter.valid, err = iter.block.seekToLast()
+	return err
+}
 
-	buf = make([]byte, 4)
-	if _, err := io.ReadFull(reader, buf); err != nil {
-		return nil, err
+// advance moves to the next item, crossing into the next block once the
+// current one is exhausted.
+func (iter *tableIterator) advance() error {
+	item, ok, err := iter.block.next()
+	if err != nil {
+		return err
+	}
+	if ok {
+		iter.item = item
+		return nil
 	}
-	itemCount := binary.BigEndian.Uint32(buf)
+	if err := iter.index.next(); err != nil {
+		return err
+	}
+	if !iter.index.valid() {
+		iter.valid = false
+		return nil
+	}
+	return iter.loadBlock()
+}
 
-	return &indexEntry{
-		key:       key,
-		offset:    indexOffset,
-		blockSize: blockSize,
-		itemCount: itemCount,
-	}, nil
+// retreat moves to the previous item, crossing into the previous block once
+// the current one's first item is reached.
+func (iter *tableIterator) retreat() error {
+	item, ok, err := iter.block.prev()
+	if err != nil {
+		return err
+	}
+	if ok {
+		iter.item = item
+		return nil
+	}
+	if err := iter.index.prev(); err != nil {
+		return err
+	}
+	if !iter.index.valid() {
+		iter.valid = false
+		return nil
+	}
+	if err := iter.loadBlock(); err != nil {
+		return err
+	}
+	iter.item, iter.valid, err = iter.block.seekToLast()
+	return err
+}
+
+// loadBlock reads the block the index is at and positions the iterator at
+// its first item.
+func (iter *tableIterator) loadBlock() error {
+	iter.valid = false
+	entry := iter.index.current()
+	data, err := iter.t.readBlock(iter.file, int64(entry.offset), int(entry.blockSize))
+	if err != nil {
+		return err
+	}
+	if iter.block, err = iter.t.newBlockIterator(int64(entry.offset), data); err != nil {
+		return err
+	}
+	iter.item, iter.valid, err = iter.block.next()
+	return err
+}
+
+// writeBlock writes data followed by its block trailer, compressing it with
+// codec if that saves enough space to be worth it. It returns the size of the
+// block as stored, and whether it was compressed.
+func writeBlock(w io.Writer, data []byte, codec Codec) (int, bool, error) {
+	contents := data
+	compressionType := byte(NO_COMPRESSION_ID)
+	if codec.ID() != NO_COMPRESSION_ID {
+		// compressed blocks have to be decompressed on every read, so they
+		// must save at least an eighth of the space
+		if compressed := codec.Compress(data); len(compressed) < len(data)-len(data)/8 {
+			contents = compressed
+			compressionType = codec.ID()
+		}
+	}
+
+	trailer := []byte{compressionType}
+	checksum := crc32.Update(crc32.Checksum(contents, crcTable), crcTable, trailer)
+	trailer = binary.BigEndian.AppendUint32(trailer, checksum)
+	if _, err := w.Write(contents); err != nil {
+		return 0, false, err
+	}
+	if _, err := w.Write(trailer); err != nil {
+		return 0, false, err
+	}
+	return len(contents), compressionType != NO_COMPRESSION_ID, nil
 }
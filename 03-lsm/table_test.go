@@ -2,11 +2,17 @@ package table
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
+	"sync"
 	"testing"
+	"time"
 )
 
 // min and max are inclusive.
@@ -35,7 +41,7 @@ func generateSortedItems(n int) []Item {
 	result := make([]Item, n)
 	for i, key := range keys {
 		value := randomWord(10, 20)
-		result[i] = Item{key, value}
+		result[i] = Item{Key: key, Value: value}
 	}
 	return result
 }
@@ -89,21 +95,798 @@ func TestTable(t *testing.T) {
 		}
 	}
 
-	// TODO: Uncomment the following to test RangeScan
-	/*
-		expectedScan := sortedItems[n/4 : n/3]
-		startKey := expectedScan[0].Key
-		endKey := expectedScan[len(expectedScan)-1].Key
-		iter, err := table.RangeScan(startKey, endKey)
+	expectedScan := sortedItems[n/4 : n/3]
+	startKey := expectedScan[0].Key
+	endKey := expectedScan[len(expectedScan)-1].Key
+	iter, err := table.RangeScan(startKey, endKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actualScan := make([]Item, 0, len(expectedScan))
+	for ; iter.Valid(); iter.Next() {
+		actualScan = append(actualScan, iter.Item())
+	}
+	if !reflect.DeepEqual(expectedScan, actualScan) {
+		t.Fatalf("Unexpected RangeScan result\n\nExpected: %v\n\nActual: %v", expectedScan, actualScan)
+	}
+}
+
+func TestTableTombstones(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpfile := filepath.Join(dir, "tmpfile")
+
+	sortedItems := generateSortedItems(1000)
+	for i := range sortedItems {
+		if i%3 == 0 {
+			sortedItems[i] = Item{Key: sortedItems[i].Key, Kind: KindTombstone}
+		}
+	}
+
+	if err := Build(tmpfile, sortedItems); err != nil {
+		t.Fatalf("Error building Table: %v", err)
+	}
+	table, err := LoadTable(tmpfile)
+	if err != nil {
+		t.Fatalf("Error loading Table: %v", err)
+	}
+
+	for _, item := range sortedItems {
+		value, ok, err := table.Get(item.Key)
+		if err != nil {
+			t.Fatalf("Error performing point read for key %q: %v", item.Key, err)
+		}
+		if ok != (item.Kind == KindValue) || value != item.Value {
+			t.Fatalf("Key %q: expected (%q, %t), got (%q, %t) instead", item.Key, item.Value, item.Kind == KindValue, value, ok)
+		}
+
+		actual, ok, err := table.Lookup(item.Key)
+		if err != nil {
+			t.Fatalf("Error performing point read for key %q: %v", item.Key, err)
+		}
+		if !ok || actual != item {
+			t.Fatalf("Key %q: expected entry %v, got %v instead", item.Key, item, actual)
+		}
+	}
+
+	iter, err := table.RangeScan(sortedItems[0].Key, sortedItems[len(sortedItems)-1].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actualScan := make([]Item, 0, len(sortedItems))
+	for ; iter.Valid(); iter.Next() {
+		actualScan = append(actualScan, iter.Item())
+	}
+	if !reflect.DeepEqual(sortedItems, actualScan) {
+		t.Fatalf("Unexpected RangeScan result\n\nExpected: %v\n\nActual: %v", sortedItems, actualScan)
+	}
+}
+
+func TestTableVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// keys get 1 to 4 versions, except for one whose 1000 versions span many
+	// blocks; each key's versions have sequence numbers 10 apart, newest
+	// first, and every third version is a tombstone
+	var sortedItems []Item
+	for i, item := range generateSortedItems(500) {
+		n := 1 + i%4
+		if i == 250 {
+			n = 1000
+		}
+		for j := n; j > 0; j-- {
+			version := Item{Key: item.Key, Value: fmt.Sprintf("%v-%d", item.Value, j), Seq: uint64(10 * j)}
+			if j%3 == 0 {
+				version = Item{Key: item.Key, Kind: KindTombstone, Seq: version.Seq}
+			}
+			sortedItems = append(sortedItems, version)
+		}
+	}
+
+	for _, opts := range []*Options{nil, {IndexPartitionSize: 1}} {
+		tmpfile := filepath.Join(dir, "tmpfile")
+		if err := BuildWithOptions(tmpfile, sortedItems, opts); err != nil {
+			t.Fatalf("Error building Table: %v", err)
+		}
+		table, err := LoadTable(tmpfile)
 		if err != nil {
+			t.Fatalf("Error loading Table: %v", err)
+		}
+
+		for i, item := range sortedItems {
+			// the version is found as of its own sequence number and of any
+			// up to the next one's, and an older one is found before it
+			newest := i == 0 || sortedItems[i-1].Key != item.Key
+			seqs := []uint64{item.Seq, item.Seq + 9}
+			if newest {
+				seqs = append(seqs, MAX_SEQUENCE)
+			}
+			for _, seq := range seqs {
+				actual, ok, err := table.LookupAt(item.Key, seq)
+				if err != nil || !ok || actual != item {
+					t.Fatalf("LookupAt(%q, %d): expected %v, got (%v, %t, %v)", item.Key, seq, item, actual, ok, err)
+				}
+			}
+			if item.Seq == 10 {
+				if actual, ok, err := table.LookupAt(item.Key, 9); err != nil || ok {
+					t.Fatalf("LookupAt(%q, 9): expected no entry, got (%v, %t, %v)", item.Key, actual, ok, err)
+				}
+			}
+			if newest {
+				if actual, ok, err := table.Lookup(item.Key); err != nil || !ok || actual != item {
+					t.Fatalf("Lookup(%q): expected %v, got (%v, %t, %v)", item.Key, item, actual, ok, err)
+				}
+			}
+		}
+
+		if actual := scanAll(t, table); !reflect.DeepEqual(sortedItems, actual) {
+			t.Fatalf("Unexpected RangeScan result")
+		}
+		p := table.Properties()
+		if p.NumEntries != uint64(len(sortedItems)) || p.SmallestSeq != 10 || p.LargestSeq != 10000 {
+			t.Fatalf("Unexpected properties %+v", p)
+		}
+		table.Close()
+	}
+}
+
+// reverseScan returns what iter produces from its last item back to its first.
+func reverseScan(t *testing.T, iter Iterator) []Item {
+	items := []Item{}
+	for iter.SeekToLast(); iter.Valid(); iter.Prev() {
+		items = append(items, iter.Item())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("Error during reverse scan: %v", err)
+	}
+	return items
+}
+
+func TestTableSeek(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// every other key gets a second version
+	var sortedItems []Item
+	for i, item := range generateSortedItems(2000) {
+		if i%2 == 0 {
+			sortedItems = append(sortedItems, Item{Key: item.Key, Value: item.Value + "-new", Seq: 2})
+		}
+		sortedItems = append(sortedItems, Item{Key: item.Key, Value: item.Value, Seq: 1})
+	}
+	// firstGE returns the index of the first item whose key is >= key
+	firstGE := func(key string) int {
+		return sort.Search(len(sortedItems), func(i int) bool { return sortedItems[i].Key >= key })
+	}
+
+	for _, opts := range []*Options{nil, {IndexPartitionSize: 1}, {BlockRestartInterval: 1}} {
+		tmpfile := filepath.Join(dir, "tmpfile")
+		if err := BuildWithOptions(tmpfile, sortedItems, opts); err != nil {
+			t.Fatalf("Error building Table: %v", err)
+		}
+		table, err := LoadTableWithOptions(tmpfile, opts)
+		if err != nil {
+			t.Fatalf("Error loading Table: %v", err)
+		}
+
+		// ranges that cover the whole table, start and end between keys, and
+		// hold nothing at all
+		n := len(sortedItems)
+		for _, r := range [][2]string{
+			{"", "zzzzzzzzzzzzzzzzzzzz"},
+			{sortedItems[n/4].Key + "a", sortedItems[n/2].Key},
+			{sortedItems[n/4].Key, sortedItems[n/2].Key + "a"},
+			{sortedItems[n/2].Key + "a", sortedItems[n/2].Key + "b"},
+			{"zzzzzzzzzzzzzzzzzzzzz", "zzzzzzzzzzzzzzzzzzzzzz"},
+		} {
+			startKey, endKey := r[0], r[1]
+			expected := sortedItems[firstGE(startKey):firstGE(endKey+"\x00")]
+			iter, err := table.RangeScan(startKey, endKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual := []Item{}
+			for ; iter.Valid(); iter.Next() {
+				actual = append(actual, iter.Item())
+			}
+			reversed := make([]Item, 0, len(expected))
+			for i := len(expected) - 1; i >= 0; i-- {
+				reversed = append(reversed, expected[i])
+			}
+			if !reflect.DeepEqual(expected, actual) {
+				t.Fatalf("Range [%q, %q]: unexpected forward scan", startKey, endKey)
+			}
+			// the iterator ran off the end, and can still be moved back to it
+			if actual := reverseScan(t, iter); !reflect.DeepEqual(reversed, actual) {
+				t.Fatalf("Range [%q, %q]: unexpected reverse scan", startKey, endKey)
+			}
+
+			for i := 0; i < 100; i++ {
+				// seek to a key that may or may not be in the table, then walk a
+				// few items forward, and back again past where the walk started
+				key := sortedItems[rand.Intn(n)].Key
+				if i%2 == 1 {
+					key = randomWord(1, 16)
+				}
+				start := firstGE(key) - firstGE(startKey)
+				if start < 0 {
+					start = 0
+				}
+				iter.Seek(key)
+				index := start
+				for ; index < len(expected) && index < start+5; index++ {
+					if !iter.Valid() || iter.Item() != expected[index] {
+						t.Fatalf("Range [%q, %q]: expected item %d after seeking to %q", startKey, endKey, index, key)
+					}
+					iter.Next()
+				}
+				if index >= len(expected) {
+					if iter.Valid() {
+						t.Fatalf("Range [%q, %q]: expected Next to run off the end of the range", startKey, endKey)
+					}
+					continue
+				}
+				for index--; index >= 0 && index > start-5; index-- {
+					iter.Prev()
+					if !iter.Valid() || iter.Item() != expected[index] {
+						t.Fatalf("Range [%q, %q]: expected item %d moving back after seeking to %q", startKey, endKey, index, key)
+					}
+				}
+				if index < 0 {
+					if iter.Prev(); iter.Valid() {
+						t.Fatalf("Range [%q, %q]: expected Prev to run off the start of the range", startKey, endKey)
+					}
+				}
+				if err := iter.Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		table.Close()
+	}
+}
+
+func TestTableRangeTombstones(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sortedItems := generateSortedItems(1000)
+	for i := range sortedItems {
+		sortedItems[i].Seq = uint64(10 + i%10)
+	}
+	// tombstones newer and older than the items they span, some of which
+	// start or end between keys, and one that spans no key at all
+	n := len(sortedItems)
+	tombstones := []RangeTombstone{
+		{Start: sortedItems[100].Key, End: sortedItems[199].Key, Seq: 20},
+		{Start: sortedItems[150].Key + "a", End: sortedItems[300].Key, Seq: 5},
+		{Start: sortedItems[500].Key, End: sortedItems[500].Key, Seq: 30},
+		{Start: "", End: sortedItems[10].Key + "a", Seq: 15},
+		{Start: sortedItems[n-1].Key + "a", End: sortedItems[n-1].Key + "b", Seq: 40},
+		{Start: sortedItems[100].Key, End: sortedItems[120].Key, Seq: 25},
+	}
+
+	tmpfile := filepath.Join(dir, "tmpfile")
+	b, err := NewTableBuilder(tmpfile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddRangeTombstone(tombstones[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range sortedItems {
+		if err := b.AddItem(item); err != nil {
 			t.Fatal(err)
 		}
-		actualScan := make([]Item, 0, len(expectedScan))
+	}
+	for _, r := range tombstones[1:] {
+		if err := b.AddRangeTombstone(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.AddRangeTombstone(RangeTombstone{Start: "b", End: "a", Seq: 1}); err == nil {
+		t.Fatalf("Expected a range tombstone that ends before it starts to be rejected")
+	}
+	if err := b.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	table, err := LoadTable(tmpfile)
+	if err != nil {
+		t.Fatalf("Error loading Table: %v", err)
+	}
+	defer table.Close()
+
+	expected := append([]RangeTombstone(nil), tombstones...)
+	sort.Slice(expected, func(i, j int) bool {
+		if expected[i].Start != expected[j].Start {
+			return expected[i].Start < expected[j].Start
+		}
+		return expected[i].Seq > expected[j].Seq
+	})
+	if actual := table.RangeTombstones(); !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("Expected range tombstones %v, got %v", expected, actual)
+	}
+	p := table.Properties()
+	if p.NumRangeDeletions != uint64(len(tombstones)) || p.NumEntries != uint64(n) || p.SmallestSeq != 5 || p.LargestSeq != 40 {
+		t.Fatalf("Unexpected properties %+v", p)
+	}
+
+	for _, item := range sortedItems {
+		covered := false
+		for _, r := range tombstones {
+			covered = covered || r.Covers(item)
+		}
+		value, ok, err := table.Get(item.Key)
+		if err != nil || ok == covered || ok && value != item.Value {
+			t.Fatalf("Key %q: expected (%q, %t), got (%q, %t, %v)", item.Key, item.Value, !covered, value, ok, err)
+		}
+		// Lookup and RangeScan leave range tombstones to the caller
+		if actual, ok, err := table.Lookup(item.Key); err != nil || !ok || actual != item {
+			t.Fatalf("Lookup(%q): expected %v, got (%v, %t, %v)", item.Key, item, actual, ok, err)
+		}
+	}
+	if actual := scanAll(t, table); !reflect.DeepEqual(sortedItems, actual) {
+		t.Fatalf("Unexpected RangeScan result")
+	}
+
+	// a table may hold nothing but range tombstones
+	if b, err = NewTableBuilder(tmpfile, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddRangeTombstone(tombstones[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	empty, err := LoadTable(tmpfile)
+	if err != nil {
+		t.Fatalf("Error loading Table: %v", err)
+	}
+	defer empty.Close()
+	if actual := empty.RangeTombstones(); !reflect.DeepEqual(tombstones[:1], actual) {
+		t.Fatalf("Expected range tombstones %v, got %v", tombstones[:1], actual)
+	}
+	if actual := scanAll(t, empty); len(actual) != 0 {
+		t.Fatalf("Expected no entries, got %v", actual)
+	}
+}
+
+// Many goroutines read tables sharing small caches at once, so that blocks
+// and files are evicted and reloaded under them. Meant to be run with -race.
+func TestTableConcurrentReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := &Options{BlockCache: NewCache(16 * 1024), FileCache: NewFileCache(1)}
+	var tables []*Table
+	var contents [][]Item
+	for i := 0; i < 3; i++ {
+		tmpfile := filepath.Join(dir, fmt.Sprintf("table%d", i))
+		sortedItems := generateSortedItems(2000)
+		if err := Build(tmpfile, sortedItems); err != nil {
+			t.Fatalf("Error building Table: %v", err)
+		}
+		loadOpts := *opts
+		loadOpts.MMap = i == 0
+		table, err := LoadTableWithOptions(tmpfile, &loadOpts)
+		if err != nil {
+			t.Fatalf("Error loading Table: %v", err)
+		}
+		defer table.Close()
+		tables = append(tables, table)
+		contents = append(contents, sortedItems)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 200; round++ {
+				i := rand.Intn(len(tables))
+				items := contents[i]
+				item := items[rand.Intn(len(items))]
+				if value, ok, err := tables[i].Get(item.Key); err != nil || !ok || value != item.Value {
+					errs <- fmt.Errorf("table %d: key %q: expected value %q, got (%q, %t, %v)", i, item.Key, item.Value, value, ok, err)
+					return
+				}
+
+				start := rand.Intn(len(items) - 20)
+				expected := items[start : start+20]
+				iter, err := tables[i].RangeScan(expected[0].Key, expected[len(expected)-1].Key)
+				if err != nil {
+					errs <- err
+					return
+				}
+				var actual []Item
+				if round%2 == 0 {
+					for ; iter.Valid(); iter.Next() {
+						actual = append(actual, iter.Item())
+					}
+				} else {
+					for iter.SeekToLast(); iter.Valid(); iter.Prev() {
+						actual = append([]Item{iter.Item()}, actual...)
+					}
+				}
+				if err := iter.Err(); err != nil || !reflect.DeepEqual(expected, actual) {
+					errs <- fmt.Errorf("table %d: unexpected RangeScan result %v (err %v), expected %v", i, actual, err, expected)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestTableBloomFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := 20000
+	sortedItems := generateSortedItems(n)
+	toInclude := make([]Item, 0, n/2)
+	toExclude := make([]Item, 0, n/2)
+	for i, item := range sortedItems {
+		if i%2 == 0 {
+			toInclude = append(toInclude, item)
+		} else {
+			toExclude = append(toExclude, item)
+		}
+	}
+
+	for _, bitsPerKey := range []int{5, 10, 20} {
+		tmpfile := filepath.Join(dir, fmt.Sprintf("bloom%d", bitsPerKey))
+		if err := BuildWithOptions(tmpfile, toInclude, &Options{BloomBitsPerKey: bitsPerKey}); err != nil {
+			t.Fatalf("Error building Table: %v", err)
+		}
+		table, err := LoadTable(tmpfile)
+		if err != nil {
+			t.Fatalf("Error loading Table: %v", err)
+		}
+		if table.filter == nil {
+			t.Fatalf("Expected the table to have a Bloom filter")
+		}
+
+		for _, item := range toInclude {
+			if !table.filter.mayContain(item.Key) {
+				t.Fatalf("Bloom filter rejected key %q which is in the table", item.Key)
+			}
+		}
+		falsePositives := 0
+		for _, item := range toExclude {
+			if table.filter.mayContain(item.Key) {
+				falsePositives++
+			}
+			if _, ok, err := table.Get(item.Key); err != nil || ok {
+				t.Fatalf("Expected key %q not to exist (err %v)", item.Key, err)
+			}
+		}
+		rate := float64(falsePositives) / float64(len(toExclude))
+		t.Logf("%d bits per key: false positive rate %.2f%% (%d / %d)", bitsPerKey, 100*rate, falsePositives, len(toExclude))
+		// the theoretical rate with 10 bits per key is a little under 1%
+		if bitsPerKey == 10 && rate > 0.02 {
+			t.Fatalf("False positive rate %.2f%% is too high for %d bits per key", 100*rate, bitsPerKey)
+		}
+	}
+
+	tmpfile := filepath.Join(dir, "nobloom")
+	if err := BuildWithOptions(tmpfile, toInclude, &Options{BloomBitsPerKey: -1}); err != nil {
+		t.Fatalf("Error building Table: %v", err)
+	}
+	table, err := LoadTable(tmpfile)
+	if err != nil {
+		t.Fatalf("Error loading Table: %v", err)
+	}
+	if table.filter != nil {
+		t.Fatalf("Expected the table not to have a Bloom filter")
+	}
+	for _, item := range toInclude[:100] {
+		if value, ok, err := table.Get(item.Key); err != nil || !ok || value != item.Value {
+			t.Fatalf("Key %q: expected value %q, got (%q, %t, %v)", item.Key, item.Value, value, ok, err)
+		}
+	}
+}
+
+// buildCorruptibleTable builds a table spanning a few blocks and returns its
+// contents along with the items in it.
+func buildCorruptibleTable(t testing.TB, dir string, opts *Options) ([]byte, []Item) {
+	sortedItems := generateSortedItems(120)
+	sortedItems[len(sortedItems)/2].Kind = KindTombstone
+	sortedItems[len(sortedItems)/2].Value = ""
+	path := filepath.Join(dir, "original")
+	if err := BuildWithOptions(path, sortedItems, opts); err != nil {
+		t.Fatalf("Error building Table: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, sortedItems
+}
+
+// checkCorruptTable loads the table at path, which is a damaged copy of one
+// holding sortedItems, and checks that every read either returns the right
+// result or an ErrCorruption, and that the damage is noticed by at least one
+// of them. Damage to the magic number can also leave the file unrecognizable
+// as a table.
+func checkCorruptTable(t testing.TB, path string, sortedItems []Item) {
+	checkErr := func(err error) {
+		var corruption *CorruptionError
+		if !errors.Is(err, ErrCorruption) || !errors.As(err, &corruption) {
+			t.Fatalf("Expected ErrCorruption, got %v", err)
+		}
+		if corruption.Path != path {
+			t.Fatalf("Expected the error to name %v, got %v", path, corruption.Path)
+		}
+	}
+
+	table, err := LoadTable(path)
+	if errors.Is(err, ErrNotTable) {
+		return
+	}
+	if err != nil {
+		checkErr(err)
+		return
+	}
+	defer table.Close()
+
+	detected := false
+	for i := 0; i < len(sortedItems); i += 10 {
+		item, ok, err := table.Lookup(sortedItems[i].Key)
+		if err != nil {
+			checkErr(err)
+			detected = true
+		} else if !ok || item != sortedItems[i] {
+			t.Fatalf("Lookup(%q): expected %v, got (%v, %t)", sortedItems[i].Key, sortedItems[i], item, ok)
+		}
+	}
+
+	iter, err := table.RangeScan("", "zzzzzzzzzzzzzzzzzzzz")
+	if err != nil {
+		checkErr(err)
+		return
+	}
+	i := 0
+	for ; iter.Valid(); iter.Next() {
+		if i >= len(sortedItems) || iter.Item() != sortedItems[i] {
+			t.Fatalf("RangeScan returned unexpected item %v", iter.Item())
+		}
+		i++
+	}
+	if err := iter.Err(); err != nil {
+		checkErr(err)
+		detected = true
+	}
+	if !detected {
+		t.Fatalf("Damaged table was read without an error")
+	}
+}
+
+func TestTableCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the second table has an index partition for every block
+	for _, opts := range []*Options{nil, {IndexPartitionSize: 1}} {
+		data, sortedItems := buildCorruptibleTable(t, dir, opts)
+		path := filepath.Join(dir, "corrupt")
+		corrupt := make([]byte, len(data))
+		for offset := range data {
+			copy(corrupt, data)
+			corrupt[offset] ^= 0x10
+			if err := ioutil.WriteFile(path, corrupt, 0600); err != nil {
+				t.Fatal(err)
+			}
+			checkCorruptTable(t, path, sortedItems)
+		}
+
+		for size := 0; size < len(data); size++ {
+			if err := ioutil.WriteFile(path, data[:size], 0600); err != nil {
+				t.Fatal(err)
+			}
+			checkCorruptTable(t, path, sortedItems)
+		}
+	}
+}
+
+// FuzzTableCorruption flips bits at a random offset of a table; run it with
+// `go test -fuzz FuzzTableCorruption`.
+func FuzzTableCorruption(f *testing.F) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, sortedItems := buildCorruptibleTable(f, dir, nil)
+	f.Add(uint(0), byte(0x01))
+	f.Add(uint(len(data)/2), byte(0xff))
+	f.Add(uint(len(data)-1), byte(0x80))
+
+	var mu sync.Mutex
+	n := 0
+	f.Fuzz(func(t *testing.T, offset uint, mask byte) {
+		if mask == 0 {
+			return
+		}
+		corrupt := append([]byte(nil), data...)
+		corrupt[offset%uint(len(corrupt))] ^= mask
+
+		// fuzz workers may run this concurrently
+		mu.Lock()
+		n++
+		path := filepath.Join(dir, fmt.Sprintf("corrupt%d", n))
+		mu.Unlock()
+		defer os.Remove(path)
+
+		if err := ioutil.WriteFile(path, corrupt, 0600); err != nil {
+			t.Fatal(err)
+		}
+		checkCorruptTable(t, path, sortedItems)
+	})
+}
+
+func TestTablePrefixCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// keys with long shared prefixes, written without block compression so
+	// that only prefix compression shrinks them; the odd numbers are left out
+	// so that there are missing keys between every pair of present ones
+	n := 2000
+	var sortedItems []Item
+	for i := 0; i < n; i += 2 {
+		key := fmt.Sprintf("users/%08d/profile", i)
+		sortedItems = append(sortedItems, Item{Key: key, Value: randomWord(10, 20)})
+	}
+
+	sizes := make(map[int]int64)
+	for _, restartInterval := range []int{1, 2, 16, 1000} {
+		tmpfile := filepath.Join(dir, fmt.Sprintf("restart%d", restartInterval))
+		if err := BuildWithOptions(tmpfile, sortedItems, &Options{BlockRestartInterval: restartInterval, Compression: NoCompression}); err != nil {
+			t.Fatalf("Error building Table: %v", err)
+		}
+		info, err := os.Stat(tmpfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[restartInterval] = info.Size()
+
+		table, err := LoadTable(tmpfile)
+		if err != nil {
+			t.Fatalf("Error loading Table: %v", err)
+		}
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("users/%08d/profile", i)
+			value, ok, err := table.Get(key)
+			if err != nil {
+				t.Fatalf("Restart interval %d: error getting %q: %v", restartInterval, key, err)
+			}
+			if i%2 == 1 && ok {
+				t.Fatalf("Restart interval %d: expected key %q not to exist", restartInterval, key)
+			}
+			if i%2 == 0 && (!ok || value != sortedItems[i/2].Value) {
+				t.Fatalf("Restart interval %d: key %q: expected %q, got (%q, %t)", restartInterval, key, sortedItems[i/2].Value, value, ok)
+			}
+		}
+
+		// start the scan from a missing key in the middle of a block
+		iter, err := table.RangeScan(fmt.Sprintf("users/%08d/profile", 1001), "users/99999999")
+		if err != nil {
+			t.Fatalf("Error creating RangeScan: %v", err)
+		}
+		var actualScan []Item
 		for ; iter.Valid(); iter.Next() {
 			actualScan = append(actualScan, iter.Item())
 		}
-		if !reflect.DeepEqual(expectedScan, actualScan) {
-			t.Fatalf("Unexpected RangeScan result\n\nExpected: %v\n\nActual: %v", expectedScan, actualScan)
+		if err := iter.Err(); err != nil {
+			t.Fatalf("Error during RangeScan: %v", err)
+		}
+		if !reflect.DeepEqual(sortedItems[501:], actualScan) {
+			t.Fatalf("Restart interval %d: unexpected RangeScan result", restartInterval)
+		}
+		table.Close()
+	}
+
+	t.Logf("table sizes by restart interval: %v", sizes)
+	if sizes[16] >= sizes[1]*3/4 {
+		t.Fatalf("Expected prefix compression to shrink the table, got %d bytes with it and %d without", sizes[16], sizes[1])
+	}
+}
+
+func TestTableProperties(t *testing.T) {
+	dir, err := ioutil.TempDir("", "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpfile := filepath.Join(dir, "tmpfile")
+	sortedItems := generateSortedItems(1000)
+	expected := Properties{
+		SmallestKey: sortedItems[0].Key,
+		LargestKey:  sortedItems[len(sortedItems)-1].Key,
+		NumEntries:  uint64(len(sortedItems)),
+		SmallestSeq: 100,
+		LargestSeq:  1 << 40,
+	}
+	for i := range sortedItems {
+		sortedItems[i].Seq = 1<<40 - uint64(i)
+		if i == 500 {
+			sortedItems[i].Seq = 100
+		}
+		if i%4 == 0 {
+			sortedItems[i] = Item{Key: sortedItems[i].Key, Kind: KindTombstone, Seq: sortedItems[i].Seq}
+			expected.NumTombstones++
 		}
-	*/
+		expected.RawKeySize += uint64(len(sortedItems[i].Key))
+		expected.RawValueSize += uint64(len(sortedItems[i].Value))
+	}
+
+	before := time.Now().Truncate(time.Second)
+	if err := Build(tmpfile, sortedItems); err != nil {
+		t.Fatalf("Error building Table: %v", err)
+	}
+	table, err := LoadTable(tmpfile)
+	if err != nil {
+		t.Fatalf("Error loading Table: %v", err)
+	}
+	defer table.Close()
+
+	actual := table.Properties()
+	if actual.CreationTime.Before(before) || actual.CreationTime.After(time.Now()) {
+		t.Fatalf("Unexpected creation time %v", actual.CreationTime)
+	}
+	// the rest are covered by TestTableCompression
+	expected.Compression = actual.Compression
+	expected.CreationTime = actual.CreationTime
+	expected.DataBlocks = actual.DataBlocks
+	expected.CompressedBlocks = actual.CompressedBlocks
+	expected.DataSize = actual.DataSize
+	expected.RawDataSize = actual.RawDataSize
+	if actual != expected {
+		t.Fatalf("Expected properties %+v, got %+v", expected, actual)
+	}
+
+	// tables written before these properties existed read them as zero
+	old, err := LoadTable("testdata/v1.table")
+	if err != nil {
+		t.Fatalf("Error loading Table: %v", err)
+	}
+	defer old.Close()
+	if p := old.Properties(); p.NumEntries != 0 || !p.CreationTime.IsZero() || p.DataBlocks == 0 {
+		t.Fatalf("Unexpected properties for an old table: %+v", p)
+	}
 }
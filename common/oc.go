@@ -35,6 +35,26 @@ type Iterator interface {
 	Value() string
 }
 
+// SeekableIterator is an Iterator over a range that can also be moved
+// backwards and repositioned anywhere in its range. Once it has run off
+// either end, it can only be repositioned.
+type SeekableIterator interface {
+	Iterator
+
+	// Moves to the previous item in the range. Assumes Valid() == true.
+	Prev()
+
+	// Moves to the first item whose key is >= key, or to the first item in
+	// the range if key comes before it.
+	Seek(key string)
+
+	// Moves to the first item in the range.
+	SeekToFirst()
+
+	// Moves to the last item in the range.
+	SeekToLast()
+}
+
 type Item struct {
 	Key, Value string
 }
@@ -2,6 +2,7 @@ package skip_list
 
 import (
 	"math/rand"
+	"sync"
 	"time"
 
 	"../common"
@@ -17,7 +18,11 @@ type SkipListNode struct {
 	Next []*SkipListNode
 }
 
+// SkipListOC is safe for concurrent use: any number of reads and iterators
+// may run at once, and each write waits for the reads in progress.
 type SkipListOC struct {
+	// guards every node and the fields below it
+	mu    sync.RWMutex
 	head  *SkipListNode
 	level int
 }
@@ -33,7 +38,10 @@ func NewSkipListOC() *SkipListOC {
 }
 
 func (o *SkipListOC) Get(key string) (string, bool) {
-	x := o.FirstGE(key, nil)
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	x := o.firstGE(key, nil)
 	if x != nil && x.Item.Key == key {
 		return x.Item.Value, true
 	}
@@ -41,11 +49,14 @@ func (o *SkipListOC) Get(key string) (string, bool) {
 }
 
 func (o *SkipListOC) Put(key, value string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
 	// when the search is complete (and we are ready to perform the splice),
 	// update[i] contains a pointer to the rightmost node of level i or
 	// higher that is to the left of the location of the insertion/deletion.
 	update := make([]*SkipListNode, MaxLevel)
-	x := o.FirstGE(key, update)
+	x := o.firstGE(key, update)
 
 	// update
 	if x != nil && x.Item.Key == key {
@@ -85,11 +96,14 @@ func (o *SkipListOC) Put(key, value string) bool {
 }
 
 func (o *SkipListOC) Delete(key string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
 	// when the search is complete (and we are ready to perform the splice),
 	// update[i] contains a pointer to the rightmost node of level i or
 	// higher that is to the left of the location of the insertion/deletion.
 	update := make([]*SkipListNode, MaxLevel)
-	x := o.FirstGE(key, update)
+	x := o.firstGE(key, update)
 
 	if x == nil || x.Item.Key != key {
 		return false
@@ -113,7 +127,17 @@ func (o *SkipListOC) Delete(key string) bool {
 	return true
 }
 
+// FirstGE returns the first node whose key is >= key. The node's fields may
+// only be read while nothing writes to the list.
 func (o *SkipListOC) FirstGE(key string, update []*SkipListNode) *SkipListNode {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	return o.firstGE(key, update)
+}
+
+// firstGE is FirstGE for callers that hold o.mu.
+func (o *SkipListOC) firstGE(key string, update []*SkipListNode) *SkipListNode {
 	x := o.head
 	for i := o.level; i >= 1; i-- {
 		for x.Next[i-1] != nil && x.Next[i-1].Item.Key < key {
@@ -129,7 +153,32 @@ func (o *SkipListOC) FirstGE(key string, update []*SkipListNode) *SkipListNode {
 	return x
 }
 
+// lastBefore returns the last node whose key is < key, or <= key if
+// inclusive, or nil if there's none. o.mu must be held.
+func (o *SkipListOC) lastBefore(key string, inclusive bool) *SkipListNode {
+	x := o.head
+	for i := o.level; i >= 1; i-- {
+		for x.Next[i-1] != nil && (x.Next[i-1].Item.Key < key || inclusive && x.Next[i-1].Item.Key == key) {
+			x = x.Next[i-1]
+		}
+	}
+	if x == o.head {
+		return nil
+	}
+	return x
+}
+
 func (o *SkipListOC) RangeScan(startKey, endKey string) common.Iterator {
+	return o.NewIterator(startKey, endKey)
+}
+
+// NewIterator is like RangeScan, but returns an iterator that can also move
+// backwards and be repositioned. The nodes only link forwards, so Prev and
+// SeekToLast search the list from the top, like a Get does.
+//
+// Each method of the iterator holds the list's lock while it runs, so writes
+// can be made while it's in use. It sees the ones made ahead of it.
+func (o *SkipListOC) NewIterator(startKey, endKey string) common.SeekableIterator {
 	node := o.FirstGE(startKey, nil)
 	return &skipListOCIterator{o, node, startKey, endKey}
 }
@@ -141,18 +190,55 @@ type skipListOCIterator struct {
 }
 
 func (iter *skipListOCIterator) Next() {
+	iter.o.mu.RLock()
+	defer iter.o.mu.RUnlock()
+
 	iter.node = iter.node.Next[0]
 }
 
+func (iter *skipListOCIterator) Prev() {
+	iter.o.mu.RLock()
+	defer iter.o.mu.RUnlock()
+
+	iter.node = iter.o.lastBefore(iter.node.Item.Key, false)
+}
+
+func (iter *skipListOCIterator) Seek(key string) {
+	if key < iter.startKey {
+		key = iter.startKey
+	}
+	iter.node = iter.o.FirstGE(key, nil)
+}
+
+func (iter *skipListOCIterator) SeekToFirst() {
+	iter.Seek(iter.startKey)
+}
+
+func (iter *skipListOCIterator) SeekToLast() {
+	iter.o.mu.RLock()
+	defer iter.o.mu.RUnlock()
+
+	iter.node = iter.o.lastBefore(iter.endKey, true)
+}
+
 func (iter *skipListOCIterator) Valid() bool {
-	return iter.node != nil && iter.node.Item.Key <= iter.endKey
+	iter.o.mu.RLock()
+	defer iter.o.mu.RUnlock()
+
+	return iter.node != nil && iter.startKey <= iter.node.Item.Key && iter.node.Item.Key <= iter.endKey
 }
 
 func (iter *skipListOCIterator) Key() string {
+	iter.o.mu.RLock()
+	defer iter.o.mu.RUnlock()
+
 	return iter.node.Item.Key
 }
 
 func (iter *skipListOCIterator) Value() string {
+	iter.o.mu.RLock()
+	defer iter.o.mu.RUnlock()
+
 	return iter.node.Item.Value
 }
 